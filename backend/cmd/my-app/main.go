@@ -2,14 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"keyflicks_app/internals/admission"
+	"keyflicks_app/internals/auth"
 	"keyflicks_app/internals/cache"
 	"keyflicks_app/internals/celery"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/entitlements"
+	"keyflicks_app/internals/events"
 	"keyflicks_app/internals/handlers"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/keys"
 	"keyflicks_app/internals/routes"
+	"keyflicks_app/internals/runner"
 	"keyflicks_app/internals/s3_store"
+	"keyflicks_app/internals/signature"
+	"keyflicks_app/internals/watchdog"
+	"keyflicks_app/internals/webhooks"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -83,6 +97,133 @@ func ensureBuckets(ctx context.Context, client *s3.Client, region string, bucket
 	return nil
 }
 
+// builds the queue routing rules from the environment:
+// PRIORITY_API_KEYS (comma separated) go to the high queue,
+// BULK_MIN_BYTES and BULK_PROFILES send large or heavy jobs to the bulk queue
+func queueRouter() *celery.Router {
+	var rules []celery.Rule
+
+	if keys := splitList(os.Getenv("PRIORITY_API_KEYS")); len(keys) > 0 {
+		clients := make([]string, 0, len(keys))
+		for _, key := range keys {
+			clients = append(clients, auth.HashKey(key))
+		}
+		rules = append(rules, celery.RouteUploaders(celery.QueueHigh, clients...))
+	}
+
+	if v := os.Getenv("BULK_MIN_BYTES"); v != "" {
+		minBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || minBytes <= 0 {
+			log.Fatalf("invalid BULK_MIN_BYTES %q", v)
+		}
+		rules = append(rules, celery.RouteLargerThan(celery.QueueBulk, minBytes))
+	}
+
+	if names := splitList(os.Getenv("BULK_PROFILES")); len(names) > 0 {
+		rules = append(rules, celery.RouteProfiles(celery.QueueBulk, names...))
+	}
+
+	return celery.NewRouter(celery.QueueNormal, rules...)
+}
+
+// where the rewritten playlists point players to: SEGMENT_HOST and API_HOST
+// (e.g. a CDN domain), SEGMENT_PATH_TEMPLATE and API_PATH_PREFIX. URL_OVERRIDES
+// is a JSON object of the same settings per white-label host, e.g.
+// {"watch.brand.com": {"segment_host": "https://cdn.brand.com", "api_prefix": "/brand/api"}}
+func playlistURLs() *signature.URLSet {
+	set := &signature.URLSet{
+		Default: signature.URLs{
+			SegmentHost: os.Getenv("SEGMENT_HOST"),
+			SegmentPath: os.Getenv("SEGMENT_PATH_TEMPLATE"),
+			APIHost:     os.Getenv("API_HOST"),
+			APIPrefix:   os.Getenv("API_PATH_PREFIX"),
+		},
+	}
+	if v := os.Getenv("URL_OVERRIDES"); v != "" {
+		var hosts map[string]signature.URLs
+		if err := json.Unmarshal([]byte(v), &hosts); err != nil {
+			log.Fatalf("invalid URL_OVERRIDES: %v", err)
+		}
+		set.Hosts = make(map[string]signature.URLs, len(hosts))
+		for host, urls := range hosts {
+			set.Hosts[strings.ToLower(host)] = urls
+		}
+	}
+	return set
+}
+
+// rendition caps from the environment, nil when none is set:
+// ENTITLEMENT_DEFAULT caps anonymous viewers (e.g. {"max_height": 720} for the free tier),
+// ENTITLEMENT_CLIENTS maps API keys and ENTITLEMENT_DEVICES values of the
+// X-Device-Class header to policies of their own
+func entitlementRules() entitlements.Resolver {
+	rules := &entitlements.Rules{}
+	configured := false
+
+	if v := os.Getenv("ENTITLEMENT_DEFAULT"); v != "" {
+		if err := json.Unmarshal([]byte(v), &rules.Default); err != nil {
+			log.Fatalf("invalid ENTITLEMENT_DEFAULT: %v", err)
+		}
+		configured = true
+	}
+	if v := os.Getenv("ENTITLEMENT_CLIENTS"); v != "" {
+		var byKey map[string]entitlements.Policy
+		if err := json.Unmarshal([]byte(v), &byKey); err != nil {
+			log.Fatalf("invalid ENTITLEMENT_CLIENTS: %v", err)
+		}
+		rules.Clients = make(map[string]entitlements.Policy, len(byKey))
+		for key, policy := range byKey {
+			rules.Clients[auth.HashKey(key)] = policy
+		}
+		configured = true
+	}
+	if v := os.Getenv("ENTITLEMENT_DEVICES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &rules.Devices); err != nil {
+			log.Fatalf("invalid ENTITLEMENT_DEVICES: %v", err)
+		}
+		configured = true
+	}
+
+	if !configured {
+		return nil
+	}
+	return rules
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q", name, v)
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q", name, v)
+	}
+	return d
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("no .env file found (continuing)")
@@ -100,13 +241,12 @@ func main() {
 
 	uri_secret_token := os.Getenv("URI_SIGNATURE_SECRET")
 
-	// celery configuration
-	redis_pool := createRedisPool("redis://localhost:6379")
-
-	celery_ins, err := celery.NewCelery(redis_pool)
-	if err != nil {
-		log.Printf("error occured while configuring celery : %v", err)
+	// celery configuration, REDIS_BROKER is the broker url the workers use as well
+	redis_broker := os.Getenv("REDIS_BROKER")
+	if redis_broker == "" {
+		redis_broker = "redis://localhost:6379"
 	}
+	redis_pool := createRedisPool(redis_broker)
 
 	// redis configuration
 	redis_client := redis.NewClient(&redis.Options{
@@ -115,6 +255,11 @@ func main() {
 
 	redis_ins := cache.NewRdisDB(redis_client)
 
+	event_bus := events.NewBus(redis_ins)
+
+	// job records, kept in sync with the status messages of the worker
+	job_store := jobs.NewStore(redis_ins)
+
 	// for s3 configuration
 
 	// 2. Load the base configuration (credentials, region, etc.).
@@ -136,12 +281,74 @@ func main() {
 
 	s3_ins := s3_store.NewS3Store(s3_client)
 
+	// DISPATCHER=local transcodes in-process instead of on the celery workers
+	var dispatcher dispatch.Dispatcher
+	if os.Getenv("DISPATCHER") == "local" {
+		workers := envInt("LOCAL_WORKERS", 1)
+		dispatcher = runner.NewRunner(s3_ins, event_bus, s3_pending_bucket, s3_streaming_bucket, workers, envInt("LOCAL_BACKLOG", 100))
+		log.Printf("Transcoding in-process with %d workers", workers)
+	} else {
+		celery_ins, err := celery.NewCelery(redis_pool, redis_broker, queueRouter())
+		if err != nil {
+			log.Fatalf("error occured while configuring celery : %v", err)
+		}
+		dispatcher = celery_ins
+	}
+
 	if err := ensureBuckets(context.Background(), s3_client, cfg.Region, s3_streaming_bucket, s3_pending_bucket); err != nil {
 		log.Fatalf("ensureBuckets error: %v", err)
 	}
 
+	// refuses new uploads with a 503 once ADMISSION_MAX_BACKLOG transcodes are waiting
+	admission_ins := admission.NewController(dispatcher, admission.Config{
+		MaxBacklog:  int64(envInt("ADMISSION_MAX_BACKLOG", 0)),
+		JobDuration: envDuration("ADMISSION_JOB_DURATION", 2*time.Minute),
+		Workers:     envInt("ADMISSION_WORKERS", 1),
+	})
+
+	// completion callbacks, registered per upload (callback_url) or per API key.
+	// WEBHOOK_API_KEYS (comma separated) limits who may register one, callbacks to
+	// internal addresses are refused unless their host is in WEBHOOK_ALLOWED_HOSTS
+	var webhook_clients []string
+	for _, key := range splitList(os.Getenv("WEBHOOK_API_KEYS")) {
+		webhook_clients = append(webhook_clients, auth.HashKey(key))
+	}
+	if len(webhook_clients) == 0 {
+		log.Println("WEBHOOK_API_KEYS is not set, any X-API-Key may register a webhook")
+	}
+	webhook_notifier := webhooks.NewNotifier(redis_ins, webhooks.Config{
+		Secret:       os.Getenv("WEBHOOK_SECRET"),
+		Clients:      webhook_clients,
+		AllowedHosts: splitList(os.Getenv("WEBHOOK_ALLOWED_HOSTS")),
+		MaxAttempts:  envInt("WEBHOOK_MAX_ATTEMPTS", 6),
+	})
+
+	// AES-128 segment encryption, enabled by setting CONTENT_KEY_SECRET
+	var key_store *keys.Store
+	if secret := os.Getenv("CONTENT_KEY_SECRET"); secret != "" {
+		key_store = keys.NewStore(redis_ins, secret)
+		log.Println("Encrypting new renditions with per-video content keys")
+	}
+
 	//now configuring handler
-	handler_ins := handlers.NewStreamHandler(s3_ins, redis_ins, celery_ins, uri_secret_token, s3_pending_bucket, s3_streaming_bucket, 1800)
+	// SEGMENT_EXPIRY=position signs every segment until 1800s after its start
+	// time in the video instead of 1800s after the playlist was fetched
+	handler_ins := handlers.NewStreamHandler(s3_ins, redis_ins, dispatcher, job_store, event_bus, admission_ins, webhook_notifier, key_store, playlistURLs(), entitlementRules(), uri_secret_token, s3_pending_bucket, s3_streaming_bucket, 1800, os.Getenv("SEGMENT_EXPIRY") == "position")
+
+	job_store.Observe(handler_ins.Job_updated)
+	job_store.Observe(handler_ins.Load_metadata)
+	job_store.Observe(webhook_notifier.Notify)
+	go webhook_notifier.Run(context.Background())
+	go job_store.ListenWorkerStatus(context.Background(), redis_ins)
+
+	// fails (or retries) transcodes whose worker stopped reporting
+	job_watchdog := watchdog.New(job_store, event_bus, dispatcher, handler_ins.Dispatch_job, watchdog.Config{
+		Timeout:       envDuration("WATCHDOG_TIMEOUT", 30*time.Minute),
+		QueuedTimeout: envDuration("WATCHDOG_QUEUED_TIMEOUT", 6*time.Hour),
+		Interval:      envDuration("WATCHDOG_INTERVAL", time.Minute),
+		MaxRetries:    envInt("WATCHDOG_MAX_RETRIES", 0),
+	})
+	go job_watchdog.Run(context.Background())
 
 	router := gin.Default()
 
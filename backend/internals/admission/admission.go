@@ -0,0 +1,86 @@
+package admission
+
+import (
+	"context"
+	"keyflicks_app/internals/dispatch"
+	"math"
+	"time"
+)
+
+// Config of the admission control, a MaxBacklog of 0 admits every upload
+type Config struct {
+	// number of waiting transcodes above which new uploads are refused
+	MaxBacklog int64
+	// rough duration of one transcode, used to estimate waits
+	JobDuration time.Duration
+	// number of transcodes running in parallel across all workers
+	Workers int
+	// lower bound of the Retry-After sent with a refusal
+	MinRetryAfter time.Duration
+}
+
+// Decision is the outcome of one admission check
+type Decision struct {
+	Admit bool
+	// tasks waiting in all queues
+	Backlog int64
+	// how long a new upload would wait before a worker picks it up
+	EstimatedWait time.Duration
+	// when a refused client should ask again
+	RetryAfter time.Duration
+}
+
+// Controller decides whether new uploads are accepted based on the queue backlog
+type Controller struct {
+	dispatcher dispatch.Dispatcher
+	cfg        Config
+}
+
+func NewController(dispatcher dispatch.Dispatcher, cfg Config) *Controller {
+	if cfg.JobDuration <= 0 {
+		cfg.JobDuration = 2 * time.Minute
+	}
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MinRetryAfter <= 0 {
+		cfg.MinRetryAfter = 30 * time.Second
+	}
+	return &Controller{
+		dispatcher: dispatcher,
+		cfg:        cfg,
+	}
+}
+
+// Check reads the queue depths and decides on one new upload
+func (c *Controller) Check(ctx context.Context) (*Decision, error) {
+	depths, err := c.dispatcher.QueueDepths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var backlog int64
+	for _, d := range depths {
+		backlog += d.Depth
+	}
+
+	d := &Decision{
+		Admit:         c.cfg.MaxBacklog <= 0 || backlog < c.cfg.MaxBacklog,
+		Backlog:       backlog,
+		EstimatedWait: c.wait(backlog),
+	}
+	if !d.Admit {
+		// time until the backlog drained below the limit again
+		d.RetryAfter = max(c.wait(backlog-c.cfg.MaxBacklog+1), c.cfg.MinRetryAfter)
+	}
+	return d, nil
+}
+
+// time the workers need to get through n queued tasks
+func (c *Controller) wait(n int64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	rounds := math.Ceil(float64(n) / float64(c.cfg.Workers))
+	return time.Duration(rounds) * c.cfg.JobDuration
+}
@@ -1 +1,26 @@
 package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// header API clients identify themselves with
+const APIKeyHeader = "X-API-Key"
+
+// HashKey derives the client id of an API key.
+// Only the client id is stored, so job records never leak the key itself.
+func HashKey(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ClientID returns the client id of the caller, "" for anonymous requests
+func ClientID(c *gin.Context) string {
+	return HashKey(c.GetHeader(APIKeyHeader))
+}
@@ -0,0 +1,227 @@
+// Package cachetest keeps the keys of cache.RedisDB in memory, for the tests of
+// the packages that store their state through it. Only the commands those
+// packages use are there, and pub/sub is not.
+package cachetest
+
+import (
+	"context"
+	"fmt"
+	"keyflicks_app/internals/cache"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Memory struct {
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	lists   map[string][]string
+	zsets   map[string]map[string]float64
+	expires map[string]time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		strings: map[string]string{},
+		sets:    map[string]map[string]bool{},
+		lists:   map[string][]string{},
+		zsets:   map[string]map[string]float64{},
+		expires: map[string]time.Time{},
+	}
+}
+
+// drops the key once its expiry passed, callers hold mu
+func (m *Memory) expire(key string) {
+	if at, ok := m.expires[key]; ok && !time.Now().Before(at) {
+		m.drop(key)
+	}
+}
+
+func (m *Memory) drop(key string) {
+	delete(m.strings, key)
+	delete(m.sets, key)
+	delete(m.lists, key)
+	delete(m.zsets, key)
+	delete(m.expires, key)
+}
+
+func (m *Memory) setExpiry(key string, exp_time int) {
+	if exp_time > 0 {
+		m.expires[key] = time.Now().Add(time.Duration(exp_time) * time.Second)
+	} else {
+		delete(m.expires, key)
+	}
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value interface{}, exp_time int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.strings[key] = fmt.Sprint(value)
+	m.setExpiry(key, exp_time)
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	v, ok := m.strings[key]
+	if !ok {
+		return "", cache.ErrNil
+	}
+	return v, nil
+}
+
+func (m *Memory) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		m.drop(key)
+	}
+	return nil
+}
+
+// Update runs fn under the lock, so unlike Redis it never has to retry
+func (m *Memory) Update(ctx context.Context, key string, exp_time int, fn func(current string) (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	next, err := fn(m.strings[key])
+	if err != nil {
+		return err
+	}
+	m.strings[key] = next
+	m.setExpiry(key, exp_time)
+	return nil
+}
+
+func (m *Memory) SAdd(ctx context.Context, key string, members ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	set := m.sets[key]
+	if set == nil {
+		set = map[string]bool{}
+		m.sets[key] = set
+	}
+	for _, member := range members {
+		set[fmt.Sprint(member)] = true
+	}
+	return nil
+}
+
+func (m *Memory) SRem(ctx context.Context, key string, members ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	for _, member := range members {
+		delete(m.sets[key], fmt.Sprint(member))
+	}
+	return nil
+}
+
+func (m *Memory) SMembers(ctx context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	members := make([]string, 0, len(m.sets[key]))
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *Memory) SetNX(ctx context.Context, key string, value interface{}, exp_time int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	if _, ok := m.strings[key]; ok {
+		return false, nil
+	}
+	m.strings[key] = fmt.Sprint(value)
+	m.setExpiry(key, exp_time)
+	return true, nil
+}
+
+func (m *Memory) LPushCapped(ctx context.Context, key string, maxLen int64, exp_time int, values ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	list := m.lists[key]
+	for _, v := range values {
+		list = append([]string{fmt.Sprint(v)}, list...)
+	}
+	if int64(len(list)) > maxLen {
+		list = list[:maxLen]
+	}
+	m.lists[key] = list
+	m.setExpiry(key, exp_time)
+	return nil
+}
+
+// LRange supports the negative indexes of redis
+func (m *Memory) LRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	list := m.lists[key]
+	n := int64(len(list))
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	if start > stop {
+		return []string{}, nil
+	}
+	return append([]string(nil), list[start:stop+1]...), nil
+}
+
+func (m *Memory) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	zset := m.zsets[key]
+	if zset == nil {
+		zset = map[string]float64{}
+		m.zsets[key] = zset
+	}
+	zset[member] = score
+	return nil
+}
+
+func (m *Memory) ZRangeByScore(ctx context.Context, key string, max float64, count int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	members := []string{}
+	for member, score := range m.zsets[key] {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+	zset := m.zsets[key]
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if count > 0 && int64(len(members)) > count {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+func (m *Memory) ZRem(ctx context.Context, key string, members ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(key)
+	for _, member := range members {
+		delete(m.zsets[key], fmt.Sprint(member))
+	}
+	return nil
+}
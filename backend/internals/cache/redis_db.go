@@ -2,11 +2,22 @@ package cache
 
 import (
 	"context"
+	"errors"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrNil is returned by Get when the key does not exist
+var ErrNil = redis.Nil
+
+// StreamMessage is a single entry of a Redis stream
+type StreamMessage = redis.XMessage
+
+// maximum number of optimistic retries done by Update before giving up
+const maxUpdateRetries = 10
+
 type RedisDB struct {
 	client *redis.Client
 }
@@ -32,6 +43,137 @@ func (r *RedisDB) Subscribe(ctx context.Context, channel string) *redis.PubSub {
 	return r.client.Subscribe(ctx, channel)
 }
 
+// PSubscribe subscribes to every channel matching the given glob pattern
+func (r *RedisDB) PSubscribe(ctx context.Context, pattern string) *redis.PubSub {
+	return r.client.PSubscribe(ctx, pattern)
+}
+
+func (r *RedisDB) Publish(ctx context.Context, channel string, message interface{}) error {
+	return r.client.Publish(ctx, channel, message).Err()
+}
+
 func (r *RedisDB) Get(ctx context.Context, key string) (string, error) {
 	return r.client.Get(ctx, key).Result()
 }
+
+func (r *RedisDB) Del(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// Update does an optimistic read-modify-write of a single key.
+// fn receives the current value ("" when the key is missing) and returns the new one.
+// The write is retried when the key was changed by someone else in between.
+func (r *RedisDB) Update(ctx context.Context, key string, exp_time int, fn func(current string) (string, error)) error {
+	expiration := time.Duration(exp_time) * time.Second
+
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		next, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, next, expiration)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := r.client.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return err
+	}
+	return redis.TxFailedErr
+}
+
+// XAdd appends an entry to a stream, trimming it to roughly maxLen entries
+func (r *RedisDB) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: values,
+	}).Result()
+}
+
+// XRange returns the stream entries between start and stop (inclusive, "(" prefix for exclusive)
+func (r *RedisDB) XRange(ctx context.Context, stream string, start string, stop string) ([]StreamMessage, error) {
+	return r.client.XRange(ctx, stream, start, stop).Result()
+}
+
+// XRevRangeN returns the newest count entries of a stream, newest first
+func (r *RedisDB) XRevRangeN(ctx context.Context, stream string, count int64) ([]StreamMessage, error) {
+	return r.client.XRevRangeN(ctx, stream, "+", "-", count).Result()
+}
+
+func (r *RedisDB) Expire(ctx context.Context, key string, exp_time int) error {
+	return r.client.Expire(ctx, key, time.Duration(exp_time)*time.Second).Err()
+}
+
+// DeleteMatching removes every key matching the glob pattern, using SCAN so Redis is not blocked
+func (r *RedisDB) DeleteMatching(ctx context.Context, pattern string) error {
+	iter := r.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		if err := r.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (r *RedisDB) SAdd(ctx context.Context, key string, members ...interface{}) error {
+	return r.client.SAdd(ctx, key, members...).Err()
+}
+
+func (r *RedisDB) SRem(ctx context.Context, key string, members ...interface{}) error {
+	return r.client.SRem(ctx, key, members...).Err()
+}
+
+func (r *RedisDB) SMembers(ctx context.Context, key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+// SetNX sets the key only when it does not exist yet and reports whether it did
+func (r *RedisDB) SetNX(ctx context.Context, key string, value interface{}, exp_time int) (bool, error) {
+	return r.client.SetNX(ctx, key, value, time.Duration(exp_time)*time.Second).Result()
+}
+
+// LPushCapped prepends to a list and keeps only its newest maxLen entries
+func (r *RedisDB) LPushCapped(ctx context.Context, key string, maxLen int64, exp_time int, values ...interface{}) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, values...)
+		pipe.LTrim(ctx, key, 0, maxLen-1)
+		pipe.Expire(ctx, key, time.Duration(exp_time)*time.Second)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisDB) LRange(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	return r.client.LRange(ctx, key, start, stop).Result()
+}
+
+func (r *RedisDB) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	return r.client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+}
+
+// ZRangeByScore returns up to count members scored at most max, lowest score first
+func (r *RedisDB) ZRangeByScore(ctx context.Context, key string, max float64, count int64) ([]string, error) {
+	return r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(max, 'f', -1, 64),
+		Count: count,
+	}).Result()
+}
+
+func (r *RedisDB) ZRem(ctx context.Context, key string, members ...interface{}) error {
+	return r.client.ZRem(ctx, key, members...).Err()
+}
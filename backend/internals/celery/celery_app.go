@@ -2,37 +2,240 @@ package celery
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gocelery/gocelery"
 	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
 )
 
-type Celery struct {
-	client *gocelery.CeleryClient
+// kombu publishes broadcast (fanout) messages on "/<db>.<exchange>",
+// the worker's remote control mailbox is the celery.pidbox exchange
+func pidboxChannel(db int) string {
+	return fmt.Sprintf("/%d.celery.pidbox", db)
 }
 
-func NewCelery(redis_pool *redis.Pool) (*Celery, error) {
+// BrokerDB reads the redis database number of a broker URL the way kombu does,
+// from the path ("redis://host:6379/2") and else the db query parameter, 0 by default
+func BrokerDB(broker_url string) (int, error) {
+	u, err := url.Parse(broker_url)
+	if err != nil {
+		return 0, err
+	}
+	db := strings.Trim(u.Path, "/")
+	if db == "" {
+		db = u.Query().Get("db")
+	}
+	if db == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(db)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid redis database %q in broker url", db)
+	}
+	return n, nil
+}
 
-	celeryBroker := gocelery.NewRedisBroker(redis_pool)
-	celeryBroker.QueueName = "video_tasks"
-	celeryBackend := gocelery.NewRedisBackend(redis_pool)
+// Celery dispatches transcodes to the python workers
+type Celery struct {
+	// one client per broker queue, gocelery brokers only push to a single list
+	clients map[string]*gocelery.CeleryClient
+	router  *Router
+	backend *gocelery.RedisCeleryBackend
+	pool    *redis.Pool
+	// redis database of the broker, the pool must be connected to it
+	db int
+}
 
-	cli, err := gocelery.NewCeleryClient(
-		celeryBroker,
-		celeryBackend,
-		0,
-	)
+var _ dispatch.Dispatcher = (*Celery)(nil)
 
+// NewCelery sets up a client for every queue of the router, redis_pool must be
+// dialed to broker_url. A nil router sends everything to the video_tasks queue
+func NewCelery(redis_pool *redis.Pool, broker_url string, router *Router) (*Celery, error) {
+	if router == nil {
+		router = NewRouter(QueueNormal)
+	}
+	db, err := BrokerDB(broker_url)
 	if err != nil {
 		return nil, err
 	}
 
+	celeryBackend := gocelery.NewRedisBackend(redis_pool)
+
+	clients := make(map[string]*gocelery.CeleryClient)
+	for _, queue := range router.Queues() {
+		celeryBroker := gocelery.NewRedisBroker(redis_pool)
+		celeryBroker.QueueName = queue
+
+		cli, err := gocelery.NewCeleryClient(
+			celeryBroker,
+			celeryBackend,
+			0,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+		clients[queue] = cli
+	}
+
 	return &Celery{
-		client: cli,
+		clients: clients,
+		router:  router,
+		backend: celeryBackend,
+		pool:    redis_pool,
+		db:      db,
 	}, nil
 }
 
-func (c *Celery) DispatchVideoTranscodeTask(ctx context.Context, uploadID, s3Key string) error {
-	_, err := c.client.Delay("tasks.transcode_and_upload_video", uploadID, s3Key)
+// QueueDepths reads the length of every broker queue
+func (c *Celery) QueueDepths(ctx context.Context) ([]dispatch.QueueDepth, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	queues := c.router.Queues()
+	depths := make([]dispatch.QueueDepth, 0, len(queues))
+	for _, queue := range queues {
+		n, err := redis.Int64(conn.Do("LLEN", queue))
+		if err != nil {
+			return nil, err
+		}
+		depths = append(depths, dispatch.QueueDepth{Name: queue, Depth: n})
+	}
+	return depths, nil
+}
+
+// Dispatch routes the transcode to a queue and returns the celery task
+func (c *Celery) Dispatch(ctx context.Context, req dispatch.TranscodeRequest) (*dispatch.Task, error) {
+	queue := c.router.Route(RouteInput{
+		Uploader:  req.Uploader,
+		SizeBytes: req.SizeBytes,
+		Profile:   req.Profile.Name,
+	})
+
+	kwargs := map[string]interface{}{
+		"upload_id":     req.UploadID,
+		"s3_key":        req.S3Key,
+		"profile":       req.Profile,
+		"output_prefix": req.OutputPrefix,
+		"poster_at":     req.PosterAt,
+	}
+	if req.Encryption != nil {
+		kwargs["encryption"] = map[string]string{
+			"key":     hex.EncodeToString(req.Encryption.Key),
+			"key_uri": req.Encryption.KeyURI,
+		}
+	}
+
+	res, err := c.clients[queue].DelayKwargs("tasks.transcode_and_upload_video", kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return &dispatch.Task{ID: res.TaskID, Queue: queue}, nil
+}
+
+// DispatchAudio queues the packaging of an audio track, it always goes to the fallback queue
+func (c *Celery) DispatchAudio(ctx context.Context, req dispatch.AudioRequest) (*dispatch.Task, error) {
+	queue := c.router.fallback
+	res, err := c.clients[queue].DelayKwargs("tasks.package_audio_track", map[string]interface{}{
+		"upload_id":        req.UploadID,
+		"s3_key":           req.S3Key,
+		"language":         req.Language,
+		"output_prefix":    req.OutputPrefix,
+		"bitrate":          req.Bitrate,
+		"segment_duration": req.SegmentDuration,
+		"container":        req.Container,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dispatch.Task{ID: res.TaskID, Queue: queue}, nil
+}
+
+// Revoke asks the workers to drop the task, running tasks are killed when terminate is set.
+// A task that is still waiting in the queue is removed from it directly, so the
+// cancellation also sticks when no worker is online to receive the broadcast.
+func (c *Celery) Revoke(ctx context.Context, taskID string, terminate bool) error {
+	if err := c.removeQueued(taskID); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"method": "revoke",
+		"arguments": map[string]interface{}{
+			"task_id":   taskID,
+			"terminate": terminate,
+			"signal":    "SIGTERM",
+		},
+		"destination": nil,
+		"pattern":     nil,
+		"matcher":     nil,
+	})
+	if err != nil {
+		return err
+	}
+
+	// kombu message envelope, same layout gocelery uses for task messages
+	message, err := json.Marshal(map[string]interface{}{
+		"body":             base64.StdEncoding.EncodeToString(body),
+		"content-type":     "application/json",
+		"content-encoding": "utf-8",
+		"headers": map[string]interface{}{
+			"clock":   1,
+			"expires": float64(time.Now().Add(time.Minute).Unix()),
+		},
+		"properties": map[string]interface{}{
+			"body_encoding": "base64",
+			"delivery_mode": 2,
+			"delivery_tag":  uuid.New().String(),
+			"priority":      0,
+			"delivery_info": map[string]interface{}{
+				"exchange":    "celery.pidbox",
+				"routing_key": "",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", pidboxChannel(c.db), message)
 	return err
 }
+
+// removes the message of a task that no worker has picked up yet
+func (c *Celery) removeQueued(taskID string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	for _, queue := range c.router.Queues() {
+		messages, err := redis.ByteSlices(conn.Do("LRANGE", queue, 0, -1))
+		if err != nil {
+			return err
+		}
+
+		for _, raw := range messages {
+			var msg gocelery.CeleryMessage
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				continue
+			}
+			task := msg.GetTaskMessage()
+			if task == nil || task.ID != taskID {
+				continue
+			}
+			_, err := conn.Do("LREM", queue, 1, raw)
+			return err
+		}
+	}
+	return nil
+}
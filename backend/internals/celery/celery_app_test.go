@@ -0,0 +1,32 @@
+package celery
+
+import "testing"
+
+func TestBrokerDB(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    int
+		wantErr bool
+	}{
+		{"redis://localhost:6379", 0, false},
+		{"redis://localhost:6379/", 0, false},
+		{"redis://localhost:6379/2", 2, false},
+		{"redis://:secret@redis:6379/15", 15, false},
+		{"redis://localhost:6379?db=3", 3, false},
+		{"redis://localhost:6379/x", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := BrokerDB(tt.url)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("BrokerDB(%q) error = %v", tt.url, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("BrokerDB(%q) = %d, want %d", tt.url, got, tt.want)
+		}
+	}
+	if got := pidboxChannel(2); got != "/2.celery.pidbox" {
+		t.Errorf("pidboxChannel(2) = %q", got)
+	}
+}
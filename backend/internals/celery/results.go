@@ -0,0 +1,97 @@
+package celery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// the celery-task-meta-<id> record written by the python worker
+type taskMeta struct {
+	TaskID    string          `json:"task_id"`
+	Status    string          `json:"status"`
+	Result    json.RawMessage `json:"result"`
+	Traceback *string         `json:"traceback"`
+	DateDone  *string         `json:"date_done"`
+}
+
+// TaskResult reads the state of a task from the result backend.
+// Celery only writes a record once a task starts or finishes,
+// so unknown tasks are reported as PENDING like celery does.
+func (c *Celery) TaskResult(ctx context.Context, taskID string) (*dispatch.TaskResult, error) {
+	conn := c.backend.Get()
+	defer conn.Close()
+
+	raw, err := redis.Bytes(conn.Do("GET", fmt.Sprintf("celery-task-meta-%s", taskID)))
+	if err == redis.ErrNil {
+		return &dispatch.TaskResult{TaskID: taskID, State: dispatch.StatePending}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta taskMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, fmt.Errorf("malformed result of task %s: %w", taskID, err)
+	}
+
+	res := &dispatch.TaskResult{
+		TaskID: taskID,
+		State:  meta.Status,
+	}
+	if meta.Traceback != nil {
+		res.Traceback = *meta.Traceback
+	}
+	if meta.DateDone != nil {
+		res.DoneAt = *meta.DateDone
+	}
+
+	switch meta.Status {
+	case dispatch.StateFailure, dispatch.StateRetry, dispatch.StateRevoked:
+		res.Error = parseTaskError(meta.Result)
+	default:
+		if len(meta.Result) > 0 {
+			var result interface{}
+			if err := json.Unmarshal(meta.Result, &result); err == nil {
+				res.Result = result
+			}
+		}
+	}
+	return res, nil
+}
+
+// failures are stored as {"exc_type", "exc_message", "exc_module"},
+// exc_message holds the exception args and is usually a list
+func parseTaskError(raw json.RawMessage) *dispatch.TaskError {
+	var exc struct {
+		Type    string          `json:"exc_type"`
+		Message json.RawMessage `json:"exc_message"`
+		Module  string          `json:"exc_module"`
+	}
+	if err := json.Unmarshal(raw, &exc); err != nil || exc.Type == "" {
+		// older workers and update_state(meta=...) store arbitrary payloads
+		return &dispatch.TaskError{Message: strings.Trim(string(raw), `"`)}
+	}
+
+	taskErr := &dispatch.TaskError{Type: exc.Type, Module: exc.Module}
+
+	var args []interface{}
+	var msg string
+	switch {
+	case json.Unmarshal(exc.Message, &args) == nil:
+		parts := make([]string, 0, len(args))
+		for _, a := range args {
+			parts = append(parts, fmt.Sprint(a))
+		}
+		taskErr.Message = strings.Join(parts, ", ")
+	case json.Unmarshal(exc.Message, &msg) == nil:
+		taskErr.Message = msg
+	default:
+		taskErr.Message = string(exc.Message)
+	}
+	return taskErr
+}
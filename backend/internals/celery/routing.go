@@ -0,0 +1,89 @@
+package celery
+
+// broker queues the worker pools consume from
+const (
+	QueueHigh   = "video_tasks_high"
+	QueueNormal = "video_tasks"
+	QueueBulk   = "video_tasks_bulk"
+)
+
+// RouteInput is what routing rules can decide on
+type RouteInput struct {
+	// client id of the uploader, see auth.ClientID
+	Uploader  string
+	SizeBytes int64
+	Profile   string
+}
+
+// Rule sends matching jobs to Queue
+type Rule struct {
+	Queue string
+	Match func(in RouteInput) bool
+}
+
+// Router picks the broker queue of a job, the first matching rule wins
+type Router struct {
+	fallback string
+	rules    []Rule
+}
+
+func NewRouter(fallback string, rules ...Rule) *Router {
+	return &Router{
+		fallback: fallback,
+		rules:    rules,
+	}
+}
+
+func (r *Router) Route(in RouteInput) string {
+	for _, rule := range r.rules {
+		if rule.Match(in) {
+			return rule.Queue
+		}
+	}
+	return r.fallback
+}
+
+// Queues lists every queue the router can pick, the fallback first
+func (r *Router) Queues() []string {
+	queues := []string{r.fallback}
+	seen := map[string]bool{r.fallback: true}
+	for _, rule := range r.rules {
+		if !seen[rule.Queue] {
+			seen[rule.Queue] = true
+			queues = append(queues, rule.Queue)
+		}
+	}
+	return queues
+}
+
+// RouteUploaders matches jobs uploaded by one of the given client ids
+func RouteUploaders(queue string, uploaders ...string) Rule {
+	set := make(map[string]bool, len(uploaders))
+	for _, u := range uploaders {
+		set[u] = true
+	}
+	return Rule{
+		Queue: queue,
+		Match: func(in RouteInput) bool { return in.Uploader != "" && set[in.Uploader] },
+	}
+}
+
+// RouteLargerThan matches originals of at least minBytes
+func RouteLargerThan(queue string, minBytes int64) Rule {
+	return Rule{
+		Queue: queue,
+		Match: func(in RouteInput) bool { return in.SizeBytes >= minBytes },
+	}
+}
+
+// RouteProfiles matches jobs using one of the given encoding profiles
+func RouteProfiles(queue string, names ...string) Rule {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return Rule{
+		Queue: queue,
+		Match: func(in RouteInput) bool { return set[in.Profile] },
+	}
+}
@@ -0,0 +1,101 @@
+package dash
+
+import (
+	"fmt"
+	"keyflicks_app/internals/m3u8"
+	"math"
+)
+
+// names of the CMAF files of a rendition, as written by ffmpeg's HLS muxer
+// (see hlsSegmentArgs in the runner and hls_segment_args in the worker)
+const (
+	InitSegment   = "init.mp4"
+	MediaTemplate = "seg_$Number%03d$.m4s"
+)
+
+// timescale of the generated timelines, durations are in milliseconds
+const timescale = 1000
+
+// codec strings announced per profile codec. They name the highest level the
+// ladders use, players only check that they can decode them.
+var codecs = map[string]string{
+	"h264": "avc1.640028,mp4a.40.2",
+	"hevc": "hvc1.1.6.L120.90,mp4a.40.2",
+	"av1":  "av01.0.08M.08,mp4a.40.2",
+}
+
+// Track is one rendition to list in a manifest
+type Track struct {
+	ID        string // rendition name, also its folder, e.g. "720p"
+	Bandwidth int
+	Width     int
+	Height    int
+	// HLS media playlist of the rendition, its EXTINF durations become the timeline
+	Playlist *m3u8.Playlist
+}
+
+// Build writes a static manifest addressing the fMP4 segments of the HLS renditions,
+// codec is the video codec of the profile ("h264", "hevc" or "av1")
+func Build(codec string, tracks []Track) (*MPD, error) {
+	set := &AdaptationSet{
+		ID:               "0",
+		ContentType:      "video",
+		MimeType:         "video/mp4",
+		SegmentAlignment: true,
+	}
+
+	var duration float64
+	for _, t := range tracks {
+		segments := t.Playlist.Segments()
+		if len(segments) == 0 {
+			return nil, fmt.Errorf("dash: rendition %s has no segments", t.ID)
+		}
+		if segments[0].Map == nil || segments[0].Map.Attr("URI") != InitSegment {
+			return nil, fmt.Errorf("dash: rendition %s is not made of fMP4 segments", t.ID)
+		}
+		if segments[0].URI != substitute(MediaTemplate, t.ID, t.Bandwidth, 0, 0) {
+			return nil, fmt.Errorf("dash: unexpected segment names in rendition %s", t.ID)
+		}
+
+		timeline := &SegmentTimeline{}
+		var total float64
+		for _, seg := range segments {
+			total += seg.Duration
+			d := int64(math.Round(seg.Duration * timescale))
+			if n := len(timeline.S); n > 0 && timeline.S[n-1].D == d {
+				timeline.S[n-1].R++
+				continue
+			}
+			timeline.S = append(timeline.S, S{D: d})
+		}
+		duration = math.Max(duration, total)
+
+		set.Representations = append(set.Representations, &Representation{
+			ID:        t.ID,
+			Bandwidth: t.Bandwidth,
+			Width:     t.Width,
+			Height:    t.Height,
+			Codecs:    codecs[codec],
+			BaseURL:   t.ID + "/",
+			SegmentTemplate: &SegmentTemplate{
+				Timescale:      timescale,
+				Initialization: InitSegment,
+				Media:          MediaTemplate,
+				StartNumber:    0,
+				Timeline:       timeline,
+			},
+		})
+	}
+
+	return &MPD{
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: Duration(duration),
+		MinBufferTime:             "PT2S",
+		Periods: []*Period{{
+			ID:             "0",
+			Start:          "PT0S",
+			AdaptationSets: []*AdaptationSet{set},
+		}},
+	}, nil
+}
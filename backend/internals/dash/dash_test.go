@@ -0,0 +1,210 @@
+package dash
+
+import (
+	"encoding/json"
+	"fmt"
+	"keyflicks_app/internals/m3u8"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// media playlist as ffmpeg's HLS muxer writes it for fMP4 renditions
+func fmp4Playlist(t *testing.T, durations ...float64) *m3u8.Playlist {
+	t.Helper()
+	lines := []string{"#EXTM3U", "#EXT-X-VERSION:7", "#EXT-X-TARGETDURATION:6", `#EXT-X-MAP:URI="init.mp4"`}
+	for i, d := range durations {
+		lines = append(lines, fmt.Sprintf("#EXTINF:%f,", d), fmt.Sprintf("seg_%03d.m4s", i))
+	}
+	lines = append(lines, "#EXT-X-ENDLIST")
+	p, err := m3u8.Parse(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+func TestBuildTimeline(t *testing.T) {
+	mpd, err := Build("h264", []Track{{ID: "360p", Bandwidth: 800000, Width: 640, Height: 360, Playlist: fmp4Playlist(t, 6, 6, 6, 4.5, 6)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := mpd.Periods[0].AdaptationSets[0].Representations[0]
+	want := []S{{D: 6000, R: 2}, {D: 4500}, {D: 6000}}
+	if !reflect.DeepEqual(rep.SegmentTemplate.Timeline.S, want) {
+		t.Errorf("timeline = %+v, want %+v", rep.SegmentTemplate.Timeline.S, want)
+	}
+	if mpd.MediaPresentationDuration != "PT28.500S" {
+		t.Errorf("duration = %s", mpd.MediaPresentationDuration)
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	ts, err := m3u8.Parse("#EXTM3U\n#EXTINF:6,\nseg_000.ts\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := m3u8.Parse("#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6,\nchunk-1.m4s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := m3u8.Parse("#EXTM3U\n#EXT-X-ENDLIST\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range map[string]*m3u8.Playlist{"transport stream": ts, "segment names": renamed, "no segments": empty} {
+		if _, err := Build("h264", []Track{{ID: "360p", Playlist: p}}); err == nil {
+			t.Errorf("%s: Build succeeded, want an error", name)
+		}
+	}
+}
+
+func TestExpandAndStarts(t *testing.T) {
+	tests := []struct {
+		name     string
+		template SegmentTemplate
+		media    []string
+		starts   []float64
+		total    float64
+	}{
+		{
+			name: "repeat counts",
+			template: SegmentTemplate{Timescale: 1000, Initialization: "init.mp4", Media: "seg_$Number%03d$.m4s",
+				Timeline: &SegmentTimeline{S: []S{{D: 6000, R: 2}, {D: 4500}}}},
+			media:  []string{"seg_000.m4s", "seg_001.m4s", "seg_002.m4s", "seg_003.m4s"},
+			starts: []float64{0, 6, 12, 18},
+			total:  22.5,
+		},
+		{
+			name: "start number, explicit times and other identifiers",
+			template: SegmentTemplate{Timescale: 90000, Initialization: "$RepresentationID$/init.mp4", Media: "$RepresentationID$/$Bandwidth$/$Time$-$Number$.m4s", StartNumber: 5,
+				Timeline: &SegmentTimeline{S: []S{{T: int64p(180000), D: 180000, R: 1}, {D: 45000}}}},
+			media:  []string{"720p/2800000/180000-5.m4s", "720p/2800000/360000-6.m4s", "720p/2800000/540000-7.m4s"},
+			starts: []float64{0, 2, 4},
+			total:  4.5,
+		},
+		{
+			name: "missing timescale counts seconds",
+			template: SegmentTemplate{Media: "$$$Number$.m4s",
+				Timeline: &SegmentTimeline{S: []S{{D: 3, R: 1}}}},
+			media:  []string{"$0.m4s", "$1.m4s"},
+			starts: []float64{0, 3},
+			total:  6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := tt.template
+			rep := &Representation{ID: "720p", Bandwidth: 2800000, SegmentTemplate: &tpl}
+
+			_, media, err := rep.Expand()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(media, tt.media) {
+				t.Errorf("media = %v, want %v", media, tt.media)
+			}
+			starts, total := rep.Starts()
+			if !reflect.DeepEqual(starts, tt.starts) || total != tt.total {
+				t.Errorf("starts = %v total %v, want %v total %v", starts, total, tt.starts, tt.total)
+			}
+			if len(starts) != tpl.Timeline.Count() {
+				t.Errorf("%d starts for %d segments", len(starts), tpl.Timeline.Count())
+			}
+		})
+	}
+
+	if _, _, err := (&Representation{ID: "x"}).Expand(); err == nil {
+		t.Error("Expand without a SegmentTemplate succeeded")
+	}
+	if _, _, err := (&Representation{ID: "x", SegmentTemplate: &SegmentTemplate{Media: "a"}}).Expand(); err == nil {
+		t.Error("Expand without a SegmentTimeline succeeded")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	mpd, err := Build("hevc", []Track{
+		{ID: "360p", Bandwidth: 800000, Width: 640, Height: 360, Playlist: fmp4Playlist(t, 6, 6, 4.5)},
+		{ID: "720p", Bandwidth: 2800000, Width: 1280, Height: 720, Playlist: fmp4Playlist(t, 6, 6, 4.5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := mpd.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(out), "xmlns=") != 1 {
+		t.Errorf("namespace written %d times", strings.Count(string(out), "xmlns="))
+	}
+
+	parsed, err := Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := parsed.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("round trip changed the manifest\n got: %s\nwant: %s", again, out)
+	}
+}
+
+// testdata/worker_manifest.mpd was written by write_manifest of
+// worker_application/app/dash.py for two renditions of 6, 6, 6 and 4.5 seconds.
+// Both implementations have to describe the same segments.
+func TestMatchesWorkerManifest(t *testing.T) {
+	data, err := os.ReadFile("testdata/worker_manifest.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := Build("h264", []Track{
+		{ID: "360p", Bandwidth: 800000, Width: 640, Height: 360, Playlist: fmp4Playlist(t, 6, 6, 6, 4.5)},
+		{ID: "720p", Bandwidth: 2800000, Width: 1280, Height: 720, Playlist: fmp4Playlist(t, 6, 6, 6, 4.5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := built.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ours, worker) {
+		a, _ := json.MarshalIndent(ours, "", " ")
+		b, _ := json.MarshalIndent(worker, "", " ")
+		t.Fatalf("Go and worker manifests differ\n go: %s\nworker: %s", a, b)
+	}
+
+	for _, rep := range worker.Periods[0].AdaptationSets[0].Representations {
+		init, media, err := rep.Expand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		starts, total := rep.Starts()
+		if init != InitSegment || len(media) != 4 || media[3] != "seg_003.m4s" {
+			t.Errorf("%s expands to %s %v", rep.ID, init, media)
+		}
+		if !reflect.DeepEqual(starts, []float64{0, 6, 12, 18}) || total != 22.5 {
+			t.Errorf("%s starts = %v total %v", rep.ID, starts, total)
+		}
+	}
+}
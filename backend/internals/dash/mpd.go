@@ -0,0 +1,131 @@
+// Package dash reads and writes the MPEG-DASH manifests (manifest.mpd) that are
+// packaged next to the HLS playlists of fMP4 renditions. The manifests reference
+// the same CMAF init and media segments the HLS playlists do.
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Namespace of the MPD schema
+const Namespace = "urn:mpeg:dash:schema:mpd:2011"
+
+// file next to master.m3u8 the manifest is written to
+const ManifestFile = "manifest.mpd"
+
+type MPD struct {
+	XMLName                   xml.Name   `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                  string     `xml:"profiles,attr"`
+	Type                      string     `xml:"type,attr"`
+	MediaPresentationDuration string     `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime             string     `xml:"minBufferTime,attr,omitempty"`
+	Extra                     []xml.Attr `xml:",any,attr"`
+	Periods                   []*Period  `xml:"Period"`
+}
+
+type Period struct {
+	ID             string           `xml:"id,attr,omitempty"`
+	Start          string           `xml:"start,attr,omitempty"`
+	AdaptationSets []*AdaptationSet `xml:"AdaptationSet"`
+}
+
+type AdaptationSet struct {
+	ID               string            `xml:"id,attr,omitempty"`
+	ContentType      string            `xml:"contentType,attr,omitempty"`
+	MimeType         string            `xml:"mimeType,attr,omitempty"`
+	Lang             string            `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool              `xml:"segmentAlignment,attr,omitempty"`
+	Extra            []xml.Attr        `xml:",any,attr"`
+	Representations  []*Representation `xml:"Representation"`
+}
+
+// IsVideo reports whether the set holds video representations
+func (s *AdaptationSet) IsVideo() bool {
+	return s.ContentType == "video" || strings.HasPrefix(s.MimeType, "video/")
+}
+
+type Representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       int              `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr,omitempty"`
+	Height          int              `xml:"height,attr,omitempty"`
+	Codecs          string           `xml:"codecs,attr,omitempty"`
+	Extra           []xml.Attr       `xml:",any,attr"`
+	BaseURL         string           `xml:"BaseURL,omitempty"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate,omitempty"`
+	SegmentList     *SegmentList     `xml:"SegmentList,omitempty"`
+}
+
+// SegmentTemplate addresses the segments by number, e.g. media="seg_$Number%03d$.m4s"
+type SegmentTemplate struct {
+	Timescale      int              `xml:"timescale,attr,omitempty"`
+	Initialization string           `xml:"initialization,attr,omitempty"`
+	Media          string           `xml:"media,attr"`
+	StartNumber    int              `xml:"startNumber,attr"`
+	Timeline       *SegmentTimeline `xml:"SegmentTimeline,omitempty"`
+}
+
+// SegmentList lists every segment URL, the signed manifests use it because
+// each segment carries its own signature
+type SegmentList struct {
+	Timescale      int              `xml:"timescale,attr,omitempty"`
+	Initialization *URL             `xml:"Initialization,omitempty"`
+	Timeline       *SegmentTimeline `xml:"SegmentTimeline,omitempty"`
+	SegmentURLs    []SegmentURL     `xml:"SegmentURL"`
+}
+
+type URL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type SegmentURL struct {
+	Media string `xml:"media,attr"`
+}
+
+type SegmentTimeline struct {
+	S []S `xml:"S"`
+}
+
+// S is a run of R+1 segments of duration D (in timescale units)
+type S struct {
+	T *int64 `xml:"t,attr,omitempty"`
+	D int64  `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+// Count is the number of segments of the timeline
+func (t *SegmentTimeline) Count() int {
+	n := 0
+	for _, s := range t.S {
+		n += s.R + 1
+	}
+	return n
+}
+
+// Parse reads a manifest
+func Parse(data []byte) (*MPD, error) {
+	var mpd MPD
+	if err := xml.Unmarshal(data, &mpd); err != nil {
+		return nil, fmt.Errorf("dash: %w", err)
+	}
+	// the namespace is written from XMLName again
+	extra := mpd.Extra[:0]
+	for _, a := range mpd.Extra {
+		if a.Name.Local != "xmlns" && a.Name.Space != "xmlns" {
+			extra = append(extra, a)
+		}
+	}
+	mpd.Extra = extra
+	return &mpd, nil
+}
+
+// Marshal writes the manifest with an XML declaration
+func (m *MPD) Marshal() ([]byte, error) {
+	out, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
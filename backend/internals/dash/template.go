@@ -0,0 +1,99 @@
+package dash
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// identifiers of a SegmentTemplate, with an optional printf width like $Number%03d$
+var identifierRe = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0\d+d)?\$|\$\$`)
+
+func substitute(template string, repID string, bandwidth int, number int, time int64) string {
+	return identifierRe.ReplaceAllStringFunc(template, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		parts := identifierRe.FindStringSubmatch(m)
+		format := parts[2]
+		if format == "" {
+			format = "%d"
+		}
+		switch parts[1] {
+		case "RepresentationID":
+			return repID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Bandwidth":
+			return fmt.Sprintf(format, bandwidth)
+		default:
+			return fmt.Sprintf(format, time)
+		}
+	})
+}
+
+// Expand turns the SegmentTemplate of a representation into the URL of its
+// init segment and of every media segment. The template needs a SegmentTimeline.
+func (r *Representation) Expand() (string, []string, error) {
+	t := r.SegmentTemplate
+	if t == nil {
+		return "", nil, fmt.Errorf("dash: representation %s has no SegmentTemplate", r.ID)
+	}
+	if t.Timeline == nil {
+		return "", nil, fmt.Errorf("dash: representation %s has no SegmentTimeline", r.ID)
+	}
+
+	init := ""
+	if t.Initialization != "" {
+		init = substitute(t.Initialization, r.ID, r.Bandwidth, 0, 0)
+	}
+
+	media := make([]string, 0, t.Timeline.Count())
+	number := t.StartNumber
+	var time int64
+	for _, s := range t.Timeline.S {
+		if s.T != nil {
+			time = *s.T
+		}
+		for i := 0; i <= s.R; i++ {
+			media = append(media, substitute(t.Media, r.ID, r.Bandwidth, number, time))
+			number++
+			time += s.D
+		}
+	}
+	return init, media, nil
+}
+
+// Starts returns the start time in seconds of every media segment of the
+// SegmentTimeline, relative to the first one, and the total duration
+func (r *Representation) Starts() ([]float64, float64) {
+	t := r.SegmentTemplate
+	if t == nil || t.Timeline == nil {
+		return nil, 0
+	}
+	timescale := float64(t.Timescale)
+	if timescale <= 0 {
+		timescale = 1
+	}
+
+	starts := make([]float64, 0, t.Timeline.Count())
+	var first, time int64
+	for i, s := range t.Timeline.S {
+		if s.T != nil {
+			time = *s.T
+		}
+		if i == 0 {
+			first = time
+		}
+		for j := 0; j <= s.R; j++ {
+			starts = append(starts, float64(time-first)/timescale)
+			time += s.D
+		}
+	}
+	return starts, float64(time-first) / timescale
+}
+
+// duration in the xs:duration form manifests use, e.g. PT634.567S
+func Duration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', 3, 64) + "S"
+}
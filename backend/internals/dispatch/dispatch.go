@@ -0,0 +1,113 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"keyflicks_app/internals/profiles"
+)
+
+// Dispatcher hands transcode jobs to whatever runs them,
+// the celery workers in production or an in-process runner for local development
+type Dispatcher interface {
+	// Dispatch queues the transcode and returns the task it became
+	Dispatch(ctx context.Context, req TranscodeRequest) (*Task, error)
+	// DispatchAudio queues the packaging of an extra audio track
+	DispatchAudio(ctx context.Context, req AudioRequest) (*Task, error)
+	// Revoke drops a queued task, running tasks are killed when terminate is set
+	Revoke(ctx context.Context, taskID string, terminate bool) error
+	// TaskResult reports the state of a task, unknown tasks are PENDING
+	TaskResult(ctx context.Context, taskID string) (*TaskResult, error)
+	// QueueDepths reports how many tasks wait in each queue
+	QueueDepths(ctx context.Context) ([]QueueDepth, error)
+}
+
+// TranscodeRequest describes one transcode job for the worker
+type TranscodeRequest struct {
+	UploadID string
+	// key of the original in the pending bucket
+	S3Key string
+	// encoding settings, sent in full so the worker needs no copy of the profiles
+	Profile profiles.Profile
+	// streaming bucket folder the renditions are written to, e.g. "videos/<id>/v2"
+	OutputPrefix string
+	// second of the video the poster is taken from, nil lets the worker pick
+	PosterAt *float64
+	// client id of the uploader and size of the original, used for queue routing
+	Uploader  string
+	SizeBytes int64
+	// AES-128 encryption of the segments, nil for clear segments
+	Encryption *Encryption
+}
+
+// Encryption is the content key of a transcode and the URI the playlists announce it under
+type Encryption struct {
+	Key    []byte
+	KeyURI string
+}
+
+// AudioRequest describes the packaging of an extra audio track as HLS
+type AudioRequest struct {
+	UploadID string
+	// key of the audio file in the pending bucket
+	S3Key    string
+	Language string
+	// streaming bucket folder the track is written to, e.g. "videos/<id>/audio_es"
+	OutputPrefix string
+	// AAC bitrate in bits per second
+	Bitrate int
+	// should match the segments of the video renditions, in length and
+	// container (profiles.ContainerTS when empty)
+	SegmentDuration int
+	Container       string
+}
+
+// Task is a dispatched transcode
+type Task struct {
+	ID    string
+	Queue string
+}
+
+// QueueDepth is the number of tasks waiting in one queue
+type QueueDepth struct {
+	Name  string `json:"name"`
+	Depth int64  `json:"depth"`
+}
+
+// task states, named after celery.states
+const (
+	StatePending = "PENDING"
+	StateStarted = "STARTED"
+	StateSuccess = "SUCCESS"
+	StateFailure = "FAILURE"
+	StateRevoked = "REVOKED"
+	StateRetry   = "RETRY"
+)
+
+// TaskError is the exception a failed task raised
+type TaskError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Module  string `json:"module,omitempty"`
+}
+
+func (e *TaskError) Error() string {
+	if e.Type == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// TaskResult is what the dispatcher knows about a task
+type TaskResult struct {
+	TaskID    string      `json:"task_id"`
+	State     string      `json:"state"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     *TaskError  `json:"error,omitempty"`
+	Traceback string      `json:"traceback,omitempty"`
+	DoneAt    string      `json:"date_done,omitempty"`
+}
+
+// Failed reports whether the task ended with an error
+func (r *TaskResult) Failed() bool {
+	return r.State == StateFailure
+}
@@ -0,0 +1,85 @@
+package entitlements
+
+import (
+	"fmt"
+	"keyflicks_app/internals/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// header the player (or the app backend in front of it) names the device class with, e.g. "tv"
+const DeviceClassHeader = "X-Device-Class"
+
+// Policy caps the renditions a viewer may play, zero values mean no cap
+type Policy struct {
+	MaxHeight    int   `json:"max_height,omitempty"`
+	MaxBandwidth int64 `json:"max_bandwidth,omitempty"`
+}
+
+// Allows reports whether a rendition of the given height and bandwidth may be played
+func (p Policy) Allows(height int, bandwidth int64) bool {
+	if p.MaxHeight > 0 && height > p.MaxHeight {
+		return false
+	}
+	if p.MaxBandwidth > 0 && bandwidth > p.MaxBandwidth {
+		return false
+	}
+	return true
+}
+
+// Restricted reports whether the policy caps anything
+func (p Policy) Restricted() bool {
+	return p.MaxHeight > 0 || p.MaxBandwidth > 0
+}
+
+// Intersect returns the stricter cap of both policies on every axis
+func (p Policy) Intersect(o Policy) Policy {
+	return Policy{
+		MaxHeight:    minCap(p.MaxHeight, o.MaxHeight),
+		MaxBandwidth: minCap(p.MaxBandwidth, o.MaxBandwidth),
+	}
+}
+
+func minCap[T int | int64](a, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// CacheKey tells playlists filtered by different policies apart in the cache
+func (p Policy) CacheKey() string {
+	if !p.Restricted() {
+		return "all"
+	}
+	return fmt.Sprintf("h%d-b%d", p.MaxHeight, p.MaxBandwidth)
+}
+
+// Resolver is the hook deciding the policy of a request
+type Resolver interface {
+	Resolve(c *gin.Context) Policy
+}
+
+// Rules resolves policies from the API key and the device class of the caller
+type Rules struct {
+	// policy of anonymous callers and of clients without one of their own, e.g. the free tier
+	Default Policy
+	// keyed by client id (auth.ClientID), replaces Default for partners
+	Clients map[string]Policy
+	// keyed by the DeviceClassHeader value, applied on top of the client policy
+	Devices map[string]Policy
+}
+
+func (r *Rules) Resolve(c *gin.Context) Policy {
+	if r == nil {
+		return Policy{}
+	}
+	policy := r.Default
+	if client, ok := r.Clients[auth.ClientID(c)]; ok {
+		policy = client
+	}
+	if device, ok := r.Devices[c.GetHeader(DeviceClassHeader)]; ok {
+		policy = policy.Intersect(device)
+	}
+	return policy
+}
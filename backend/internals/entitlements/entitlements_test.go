@@ -0,0 +1,104 @@
+package entitlements
+
+import (
+	"keyflicks_app/internals/auth"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		height    int
+		bandwidth int64
+		want      bool
+	}{
+		{"no cap", Policy{}, 2160, 20_000_000, true},
+		{"below height", Policy{MaxHeight: 720}, 480, 1_400_000, true},
+		{"at height", Policy{MaxHeight: 720}, 720, 2_800_000, true},
+		{"above height", Policy{MaxHeight: 720}, 1080, 5_000_000, false},
+		{"at bandwidth", Policy{MaxBandwidth: 2_800_000}, 720, 2_800_000, true},
+		{"above bandwidth", Policy{MaxBandwidth: 2_800_000}, 720, 2_800_001, false},
+		{"height ok, bandwidth over", Policy{MaxHeight: 1080, MaxBandwidth: 2_000_000}, 720, 2_800_000, false},
+		{"bandwidth ok, height over", Policy{MaxHeight: 480, MaxBandwidth: 5_000_000}, 720, 2_800_000, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.Allows(tt.height, tt.bandwidth); got != tt.want {
+			t.Errorf("%s: Allows(%d, %d) = %v, want %v", tt.name, tt.height, tt.bandwidth, got, tt.want)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Policy
+		want Policy
+	}{
+		{"both open", Policy{}, Policy{}, Policy{}},
+		{"one side capped", Policy{MaxHeight: 720}, Policy{}, Policy{MaxHeight: 720}},
+		{"other side capped", Policy{}, Policy{MaxBandwidth: 3_000_000}, Policy{MaxBandwidth: 3_000_000}},
+		{"stricter wins", Policy{MaxHeight: 1080, MaxBandwidth: 2_000_000}, Policy{MaxHeight: 720, MaxBandwidth: 5_000_000}, Policy{MaxHeight: 720, MaxBandwidth: 2_000_000}},
+		{"per axis", Policy{MaxHeight: 480}, Policy{MaxBandwidth: 1_000_000}, Policy{MaxHeight: 480, MaxBandwidth: 1_000_000}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.a.Intersect(tt.b); got != tt.want {
+			t.Errorf("%s: %+v.Intersect(%+v) = %+v, want %+v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+		if got := tt.b.Intersect(tt.a); got != tt.want {
+			t.Errorf("%s: %+v.Intersect(%+v) = %+v, want %+v", tt.name, tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rules := &Rules{
+		Default: Policy{MaxHeight: 480},
+		Clients: map[string]Policy{
+			auth.HashKey("partner"): {MaxHeight: 1080},
+			auth.HashKey("open"):    {},
+		},
+		Devices: map[string]Policy{
+			"phone": {MaxHeight: 720, MaxBandwidth: 3_000_000},
+			"tv":    {},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		rules  *Rules
+		apiKey string
+		device string
+		want   Policy
+	}{
+		{"anonymous", rules, "", "", Policy{MaxHeight: 480}},
+		{"unknown client", rules, "stranger", "", Policy{MaxHeight: 480}},
+		{"client replaces default", rules, "partner", "", Policy{MaxHeight: 1080}},
+		{"client lifts default", rules, "open", "", Policy{}},
+		{"device caps client", rules, "partner", "phone", Policy{MaxHeight: 720, MaxBandwidth: 3_000_000}},
+		{"device caps default", rules, "", "phone", Policy{MaxHeight: 480, MaxBandwidth: 3_000_000}},
+		{"device never lifts", rules, "", "tv", Policy{MaxHeight: 480}},
+		{"unknown device", rules, "partner", "fridge", Policy{MaxHeight: 1080}},
+		{"no rules", nil, "partner", "phone", Policy{}},
+	}
+
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		if tt.apiKey != "" {
+			c.Request.Header.Set(auth.APIKeyHeader, tt.apiKey)
+		}
+		if tt.device != "" {
+			c.Request.Header.Set(DeviceClassHeader, tt.device)
+		}
+		if got := tt.rules.Resolve(c); got != tt.want {
+			t.Errorf("%s: Resolve() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"keyflicks_app/internals/cache"
+	"strconv"
+	"strings"
+)
+
+// prefix of the pub/sub channels job events are published on
+const ChannelPrefix = "job_status_"
+
+const (
+	// number of events kept per job for replay
+	historyLength = 200
+	// seconds the history of a job is kept after its last event
+	historyTTL = 24 * 60 * 60
+)
+
+// Channel returns the pub/sub channel used for the events of one job
+func Channel(jobID string) string {
+	return ChannelPrefix + jobID
+}
+
+func historyKey(jobID string) string {
+	return fmt.Sprintf("job_events:%s", jobID)
+}
+
+// Bus publishes job events and keeps a short history of them in a Redis
+// stream, so late subscribers can catch up. The stream entry ID doubles as
+// the SSE event ID.
+type Bus struct {
+	redis *cache.RedisDB
+}
+
+func NewBus(rds *cache.RedisDB) *Bus {
+	return &Bus{
+		redis: rds,
+	}
+}
+
+// Publish records the event in the job history and then broadcasts it
+func (b *Bus) Publish(ctx context.Context, ev *Event) error {
+	ev.ID = ""
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	key := historyKey(ev.JobID)
+	id, err := b.redis.XAdd(ctx, key, historyLength, map[string]interface{}{"event": string(data)})
+	if err != nil {
+		return err
+	}
+	_ = b.redis.Expire(ctx, key, historyTTL)
+
+	ev.ID = id
+	data, err = json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.redis.Publish(ctx, Channel(ev.JobID), string(data))
+}
+
+// Since returns the recorded events that came after the given event ID
+func (b *Bus) Since(ctx context.Context, jobID string, lastID string) ([]*Event, error) {
+	msgs, err := b.redis.XRange(ctx, historyKey(jobID), "("+lastID, "+")
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistory(jobID, msgs)
+}
+
+// Recent returns up to n of the newest recorded events, oldest first
+func (b *Bus) Recent(ctx context.Context, jobID string, n int64) ([]*Event, error) {
+	msgs, err := b.redis.XRevRangeN(ctx, historyKey(jobID), n)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return decodeHistory(jobID, msgs)
+}
+
+func decodeHistory(jobID string, msgs []cache.StreamMessage) ([]*Event, error) {
+	out := make([]*Event, 0, len(msgs))
+	for _, msg := range msgs {
+		payload, _ := msg.Values["event"].(string)
+		ev, err := Parse(jobID, payload)
+		if err != nil {
+			// skip entries written by an incompatible publisher
+			continue
+		}
+		ev.ID = msg.ID
+		out = append(out, ev)
+	}
+	return out, nil
+}
+
+// ValidID reports whether id looks like an event ID ("<ms>-<seq>")
+func ValidID(id string) bool {
+	_, _, ok := splitID(id)
+	return ok
+}
+
+// CompareIDs orders two event IDs like strings.Compare does
+func CompareIDs(a string, b string) int {
+	ams, aseq, _ := splitID(a)
+	bms, bseq, _ := splitID(b)
+	switch {
+	case ams != bms:
+		if ams < bms {
+			return -1
+		}
+		return 1
+	case aseq != bseq:
+		if aseq < bseq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func splitID(id string) (uint64, uint64, bool) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
@@ -0,0 +1,193 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// version of the event schema produced by this service and the worker
+const SchemaVersion = 1
+
+// Type is also used as the SSE "event:" field
+type Type string
+
+const (
+	// job changed state (queued, processing, ready, failed, cancelled)
+	TypeStatus Type = "status"
+	// progress report while the job is processing
+	TypeProgress Type = "progress"
+	// state change of an extra track (e.g. an added audio language),
+	// these leave the state of the job itself alone
+	TypeTrack Type = "track"
+)
+
+// states a track event can carry
+var knownTrackStates = map[string]bool{
+	"processing": true,
+	"ready":      true,
+	"failed":     true,
+}
+
+// the job states an event can carry, these mirror jobs.Status
+var knownStatuses = map[string]bool{
+	"awaiting_upload": true,
+	"queued":          true,
+	"processing":      true,
+	"ready":           true,
+	"failed":          true,
+	"cancelled":       true,
+}
+
+// state of a single output rendition, e.g. "720p"
+type RenditionState struct {
+	State   string  `json:"state"` // pending, running, done, failed
+	Percent float64 `json:"percent"`
+}
+
+// TrackState is the payload of a track event
+type TrackState struct {
+	Kind     string `json:"kind"` // audio
+	Language string `json:"language"`
+	State    string `json:"state"` // processing, ready, failed
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Event is the versioned message published on job_status_<id>
+type Event struct {
+	Version    int                       `json:"v"`
+	ID         string                    `json:"id,omitempty"`
+	Seq        int64                     `json:"seq,omitempty"`
+	Type       Type                      `json:"type"`
+	JobID      string                    `json:"job_id,omitempty"`
+	Status     string                    `json:"status,omitempty"`
+	Stage      string                    `json:"stage,omitempty"`
+	Percent    *float64                  `json:"percent,omitempty"`
+	Rendition  string                    `json:"rendition,omitempty"`
+	Renditions map[string]RenditionState `json:"renditions,omitempty"`
+	ETASeconds *float64                  `json:"eta_seconds,omitempty"`
+	Error      *ErrorDetail              `json:"error,omitempty"`
+	Track      *TrackState               `json:"track,omitempty"`
+	// version of the renditions the job event is about, the live version
+	// keeps being served while a later one is queued, processing, failed or cancelled
+	PendingVersion int       `json:"pending_version,omitempty"`
+	Timestamp      time.Time `json:"ts"`
+}
+
+// NewStatusEvent builds a state change event, reason is only used for failures
+func NewStatusEvent(jobID string, status string, reason string) *Event {
+	ev := &Event{
+		Version:   SchemaVersion,
+		Type:      TypeStatus,
+		JobID:     jobID,
+		Status:    status,
+		Timestamp: time.Now().UTC(),
+	}
+	if status == "failed" {
+		if reason == "" {
+			reason = "transcoding failed"
+		}
+		ev.Error = &ErrorDetail{Message: reason}
+	}
+	return ev
+}
+
+// NewTrackEvent builds a track state change event, reason is only used for failures
+func NewTrackEvent(jobID string, kind string, language string, state string, reason string) *Event {
+	ev := &Event{
+		Version:   SchemaVersion,
+		Type:      TypeTrack,
+		JobID:     jobID,
+		Track:     &TrackState{Kind: kind, Language: language, State: state},
+		Timestamp: time.Now().UTC(),
+	}
+	if state == "failed" {
+		if reason == "" {
+			reason = "packaging failed"
+		}
+		ev.Error = &ErrorDetail{Message: reason}
+	}
+	return ev
+}
+
+// Terminal reports whether no further events will follow for the job
+func (e *Event) Terminal() bool {
+	if e.Type == TypeTrack {
+		return false
+	}
+	return e.Status == "ready" || e.Status == "failed" || e.Status == "cancelled"
+}
+
+func (e *Event) Validate() error {
+	if e.Version != SchemaVersion {
+		return fmt.Errorf("unsupported event version %d", e.Version)
+	}
+	if e.Type == TypeTrack {
+		if e.Track == nil || e.Track.Kind == "" || e.Track.Language == "" {
+			return errors.New("track events must name the track")
+		}
+		if !knownTrackStates[e.Track.State] {
+			return fmt.Errorf("unknown track state %q", e.Track.State)
+		}
+		return nil
+	}
+	if e.Type != TypeStatus && e.Type != TypeProgress {
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+	if !knownStatuses[e.Status] {
+		return fmt.Errorf("unknown job status %q", e.Status)
+	}
+	if e.Percent != nil && (*e.Percent < 0 || *e.Percent > 100) {
+		return fmt.Errorf("percent %v out of range", *e.Percent)
+	}
+	for name, r := range e.Renditions {
+		if r.Percent < 0 || r.Percent > 100 {
+			return fmt.Errorf("percent %v of rendition %s out of range", r.Percent, name)
+		}
+	}
+	if e.ETASeconds != nil && *e.ETASeconds < 0 {
+		return errors.New("eta_seconds must not be negative")
+	}
+	if e.Status == "failed" && (e.Error == nil || e.Error.Message == "") {
+		return errors.New("failed events must carry an error message")
+	}
+	return nil
+}
+
+// Parse decodes and validates a pub/sub payload.
+// Plain status strings ("processing", "ready", "failed") sent by older
+// workers are upgraded to status events.
+func Parse(jobID string, payload string) (*Event, error) {
+	payload = strings.TrimSpace(payload)
+
+	if !strings.HasPrefix(payload, "{") {
+		if !knownStatuses[payload] {
+			return nil, fmt.Errorf("unknown job status %q", payload)
+		}
+		return NewStatusEvent(jobID, payload, ""), nil
+	}
+
+	var ev Event
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		return nil, fmt.Errorf("malformed event: %w", err)
+	}
+	if ev.JobID == "" {
+		ev.JobID = jobID
+	}
+	if ev.JobID != jobID {
+		return nil, fmt.Errorf("event for job %s published on the channel of job %s", ev.JobID, jobID)
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	if err := ev.Validate(); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
@@ -0,0 +1,29 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// WriteSSE writes the event as a single Server-Sent Events message
+func WriteSSE(w io.Writer, ev *Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	if ev.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", ev.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	return err
+}
+
+// WriteHeartbeat writes an SSE comment, it keeps idle proxies from dropping the connection
+func WriteHeartbeat(w io.Writer) error {
+	_, err := fmt.Fprint(w, ": heartbeat\n\n")
+	return err
+}
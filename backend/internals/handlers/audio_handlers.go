@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/profiles"
+	"keyflicks_app/internals/signature"
+	"keyflicks_app/internals/subtitles"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pending bucket folder of the uploaded audio files, "audio/<id>/<lang>.<ext>"
+	audioUploadPrefix = "audio"
+	// bitrate of the packaged audio renditions
+	audioBitrate = 128000
+)
+
+var (
+	// returned when an audio track is replaced while it is being packaged
+	errTrackBusy = errors.New("audio track is being processed")
+	// returned when the video has no audio track in the language
+	errNoTrack = errors.New("no such audio track")
+)
+
+// handler to add an extra audio language to a video, e.g. a dub or a commentary.
+// Returns a presigned url the audio file is uploaded to, the track is packaged
+// once the upload arrives. ?lang= is required, ?name= and ?filename= are optional.
+func (h *StreamHandler) Add_audio_track(c *gin.Context) {
+	videoID := c.Param("id")
+	ctx := c.Request.Context()
+
+	lang := c.Query("lang")
+	if !subtitles.ValidLanguage(lang) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "lang must be a language tag like en or pt-BR"})
+		return
+	}
+	name := c.DefaultQuery("name", lang)
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(c.Query("filename")), "."))
+	if ext == "" {
+		ext = "m4a"
+	}
+	s3Key := fmt.Sprintf("%s/%s/%s.%s", audioUploadPrefix, videoID, lang, ext)
+
+	contentType := mime.TypeByExtension("." + ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	job, err := h.jobs.UpdateExisting(ctx, videoID, func(j *jobs.Job) error {
+		if t := j.AudioTrack(lang); t != nil {
+			if t.State == jobs.TrackProcessing {
+				return errTrackBusy
+			}
+			*t = jobs.AudioTrack{Language: lang, Name: name, State: jobs.TrackAwaitingUpload, S3Key: s3Key}
+			return nil
+		}
+		j.AudioTracks = append(j.AudioTracks, jobs.AudioTrack{Language: lang, Name: name, State: jobs.TrackAwaitingUpload, S3Key: s3Key})
+		return nil
+	})
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if errors.Is(err, errTrackBusy) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "The audio track of this language is still being processed"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to save audio track"})
+		return
+	}
+
+	presignedURL, err := h.S3.GeneratePresignedUploadUrl(ctx, h.pending_bucket, s3Key, contentType)
+	if err != nil {
+		log.Printf("Error generating audio upload url for %s/%s: %v", videoID, lang, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate upload url"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"presigned_url": publicUploadURL(c, presignedURL),
+		"s3_key":        s3Key,
+		"audio_tracks":  job.AudioTracks,
+	})
+}
+
+// handler to remove the audio track of one language
+func (h *StreamHandler) Delete_audio_track(c *gin.Context) {
+	videoID := c.Param("id")
+	lang := c.Param("lang")
+	ctx := c.Request.Context()
+
+	if !subtitles.ValidLanguage(lang) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid language tag"})
+		return
+	}
+
+	var removed jobs.AudioTrack
+	found := false
+	job, err := h.jobs.UpdateExisting(ctx, videoID, func(j *jobs.Job) error {
+		tracks := j.AudioTracks[:0]
+		for _, t := range j.AudioTracks {
+			if t.Language == lang {
+				removed, found = t, true
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		if !found {
+			return errNoTrack
+		}
+		j.AudioTracks = tracks
+		return nil
+	})
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if errors.Is(err, errNoTrack) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No audio track in this language"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove audio track"})
+		return
+	}
+
+	if removed.State == jobs.TrackProcessing && removed.TaskID != "" {
+		if err := h.dispatcher.Revoke(ctx, removed.TaskID, true); err != nil {
+			log.Printf("Failed to revoke audio task %s of %s: %v", removed.TaskID, videoID, err)
+		}
+	}
+
+	h.invalidateCache(ctx,
+		fmt.Sprintf("master:%s:*", videoID),
+		fmt.Sprintf("playlist:%s:%s:*", videoID, jobs.AudioDir(lang)),
+	)
+	if err := h.S3.DeletePrefix(ctx, h.streaming_bucket, path.Join("videos", videoID, jobs.AudioDir(lang))+"/"); err != nil {
+		log.Printf("Failed to delete audio files of %s/%s: %v", videoID, lang, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"audio_tracks": job.AudioTracks})
+}
+
+// handleAudioUpload starts packaging an audio file that arrived in the pending bucket
+func (h *StreamHandler) handleAudioUpload(c *gin.Context, s3Key string, etag string) {
+	ctx := c.Request.Context()
+
+	// "audio/UPLOAD_ID/LANG.m4a"
+	parts := strings.Split(s3Key, "/")
+	if len(parts) != 3 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid S3 key format"})
+		return
+	}
+	videoID := parts[1]
+	lang := strings.Split(parts[2], ".")[0]
+
+	// S3 delivers at least once, an object (key and ETag) is only packaged once
+	claim, err := h.claimAudioUpload(ctx, s3Key, etag)
+	if err != nil {
+		log.Printf("Failed to claim audio upload %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to update audio track"})
+		return
+	}
+	if claim == "" {
+		log.Printf("Ignoring repeated notification of audio upload %s", s3Key)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	job, err := h.jobs.UpdateExisting(ctx, videoID, func(j *jobs.Job) error {
+		t := j.AudioTrack(lang)
+		if t == nil || t.S3Key != s3Key {
+			return jobs.ErrNotFound
+		}
+		t.State = jobs.TrackProcessing
+		t.Error = ""
+		return nil
+	})
+	if errors.Is(err, jobs.ErrNotFound) {
+		// acknowledged so the notification is not retried
+		log.Printf("Ignoring audio upload %s, no such track", s3Key)
+		c.Status(http.StatusOK)
+		return
+	}
+	if err != nil {
+		h.releaseAudioUpload(claim)
+		log.Printf("Failed to update audio track for upload %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to update audio track"})
+		return
+	}
+
+	if err := h.dispatchAudio(ctx, job, lang, s3Key); err != nil {
+		h.releaseAudioUpload(claim)
+		log.Printf("CRITICAL: Failed to dispatch audio task for upload %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to start audio processing job"})
+		return
+	}
+
+	log.Printf("Successfully dispatched audio job for %s, s3_key: %s", videoID, s3Key)
+	c.Status(http.StatusOK)
+}
+
+// seconds an audio upload notification is remembered
+const audioClaimTTL = 24 * 60 * 60
+
+// claims the packaging of an uploaded object, the returned key is empty when
+// it was claimed before. Without an ETag or redis every notification is taken
+func (h *StreamHandler) claimAudioUpload(ctx context.Context, s3Key string, etag string) (string, error) {
+	key := fmt.Sprintf("audio_upload:%s:%s", s3Key, strings.Trim(etag, `"`))
+	if h.redis == nil || etag == "" {
+		return key, nil
+	}
+	claimed, err := h.redis.SetNX(ctx, key, 1, audioClaimTTL)
+	if err != nil || !claimed {
+		return "", err
+	}
+	return key, nil
+}
+
+// lets S3 retry a notification that could not be handled
+func (h *StreamHandler) releaseAudioUpload(claim string) {
+	if h.redis == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := h.redis.Del(ctx, claim); err != nil {
+		log.Printf("Failed to release audio upload claim %s: %v", claim, err)
+	}
+}
+
+func (h *StreamHandler) dispatchAudio(ctx context.Context, job *jobs.Job, lang string, s3Key string) error {
+	// audio segments line up with the video segments
+	segment := 6
+	container := profiles.ContainerTS
+	name := job.Profile
+	if name == "" {
+		name = profiles.Default
+	}
+	if profile, ok := profiles.Get(name); ok {
+		if profile.SegmentDuration > 0 {
+			segment = profile.SegmentDuration
+		}
+		if profile.FMP4() {
+			container = profiles.ContainerFMP4
+		}
+	}
+
+	task, err := h.dispatcher.DispatchAudio(ctx, dispatch.AudioRequest{
+		UploadID:        job.ID,
+		S3Key:           s3Key,
+		Language:        lang,
+		OutputPrefix:    path.Join("videos", job.ID, jobs.AudioDir(lang)),
+		Bitrate:         audioBitrate,
+		SegmentDuration: segment,
+		Container:       container,
+	})
+	if err != nil {
+		_, _ = h.jobs.UpdateExisting(ctx, job.ID, func(j *jobs.Job) error {
+			if t := j.AudioTrack(lang); t != nil && t.S3Key == s3Key {
+				t.State = jobs.TrackFailed
+				t.Error = fmt.Sprintf("dispatch failed: %v", err)
+			}
+			return nil
+		})
+		return err
+	}
+
+	_, err = h.jobs.UpdateExisting(ctx, job.ID, func(j *jobs.Job) error {
+		if t := j.AudioTrack(lang); t != nil && t.S3Key == s3Key {
+			t.TaskID = task.ID
+		}
+		return nil
+	})
+	return err
+}
+
+// EXT-X-MEDIA entries of the packaged audio tracks. The audio muxed into the
+// variant streams stays the default, so players without track selection keep working.
+func audioRenditions(videoID string, tracks []jobs.AudioTrack, urls signature.URLs) []signature.MediaRendition {
+	var renditions []signature.MediaRendition
+	for _, t := range tracks {
+		if t.State != jobs.TrackReady {
+			continue
+		}
+		if renditions == nil {
+			renditions = append(renditions, signature.MediaRendition{
+				Type:    "AUDIO",
+				GroupID: "aud",
+				Name:    "Original",
+				Default: true,
+			})
+		}
+		renditions = append(renditions, signature.MediaRendition{
+			Type:     "AUDIO",
+			GroupID:  "aud",
+			Name:     t.Name,
+			Language: t.Language,
+			URI:      urls.API(fmt.Sprintf("/playlist/%s/%s", videoID, jobs.AudioDir(t.Language))),
+		})
+	}
+	return renditions
+}
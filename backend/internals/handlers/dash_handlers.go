@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"keyflicks_app/internals/dash"
+	"keyflicks_app/internals/signature"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handler serving the DASH manifest of a video with signed segment URLs.
+// Only fMP4 (CMAF) profiles are packaged for DASH, other videos answer 404.
+func (h *StreamHandler) Dash_manifest(c *gin.Context) {
+	videoID := c.Param("video_id")
+	ctx := c.Request.Context()
+
+	const REFRESH_THRESHOLD_SECONDS = 25 * 60
+	cacheTTLSeconds := h.TTL + 300
+
+	urls := h.urlsFor(c)
+	policy := h.policyFor(c)
+	cacheKey := fmt.Sprintf("dash:%s:%s:%s", videoID, urls.CacheKey(), policy.CacheKey())
+	now := time.Now().Unix()
+
+	type cacheData struct {
+		Manifest  string `json:"manifest"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+
+	// Try cache
+	if h.redis != nil {
+		if cachedStr, err := h.redis.Get(ctx, cacheKey); err == nil && cachedStr != "" {
+			var cd cacheData
+			if err := json.Unmarshal([]byte(cachedStr), &cd); err == nil && cd.ExpiresAt-now > int64(REFRESH_THRESHOLD_SECONDS) {
+				c.Data(http.StatusOK, "application/dash+xml", []byte(cd.Manifest))
+				return
+			}
+			// Cache HIT but stale: fall through to regenerate
+		}
+	}
+
+	// Cache MISS or stale: fetch the manifest of the live version
+	versionDir := h.liveVersionDir(ctx, videoID)
+	s3Key := path.Join("videos", videoID, versionDir, dash.ManifestFile)
+	body, err := h.S3.GetObject(ctx, h.streaming_bucket, s3Key)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"detail": "No DASH manifest for this video"})
+		return
+	}
+	defer body.Close()
+
+	manifest, err := io.ReadAll(body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"detail": fmt.Sprintf("Failed to read DASH manifest: %v", err)})
+		return
+	}
+
+	expiry := h.segmentExpiry(now)
+	rewritten, err := signature.RewriteManifest(manifest, videoID, versionDir, expiry, h.uri_secret, urls, representationFilter(policy))
+	if errors.Is(err, signature.ErrNoRenditions) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "No rendition included in your plan"})
+		return
+	}
+	if err != nil {
+		log.Printf("Malformed DASH manifest %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"detail": "Malformed DASH manifest"})
+		return
+	}
+
+	// Background cache update (decoupled from request context)
+	go func(data cacheData) {
+		bgCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		b, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		if h.redis != nil {
+			_ = h.redis.Set(bgCtx, cacheKey, string(b), cacheTTLSeconds)
+		}
+	}(cacheData{
+		Manifest:  string(rewritten),
+		ExpiresAt: expiry.At(0),
+	})
+
+	c.Data(http.StatusOK, "application/dash+xml", rewritten)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"keyflicks_app/internals/dash"
+	"keyflicks_app/internals/entitlements"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/m3u8"
+	"keyflicks_app/internals/profiles"
+	"keyflicks_app/internals/subtitles"
+
+	"github.com/gin-gonic/gin"
+)
+
+// entitlement policy of the caller, unrestricted when no resolver is configured
+func (h *StreamHandler) policyFor(c *gin.Context) entitlements.Policy {
+	if h.entitlements == nil {
+		return entitlements.Policy{}
+	}
+	return h.entitlements.Resolve(c)
+}
+
+// keeps the variant streams of a master playlist the policy allows
+func variantFilter(policy entitlements.Policy) func(v m3u8.Variant) bool {
+	return func(v m3u8.Variant) bool {
+		return policy.Allows(v.Height(), v.Bandwidth)
+	}
+}
+
+// keeps the DASH representations the policy allows, nil when nothing is capped
+func representationFilter(policy entitlements.Policy) func(rep *dash.Representation) bool {
+	if !policy.Restricted() {
+		return nil
+	}
+	return func(rep *dash.Representation) bool {
+		return policy.Allows(rep.Height, int64(rep.Bandwidth))
+	}
+}
+
+// renditionAllowed reports whether the policy lets the caller play a rendition folder.
+// Audio and caption tracks are open to everyone, video renditions are looked up
+// in the metadata of the live version and then in the profile of the job, which
+// may have changed since for a pending re-transcode.
+// Renditions that can't be told are refused.
+func (h *StreamHandler) renditionAllowed(ctx context.Context, videoID string, resolutionPath string, policy entitlements.Policy) bool {
+	if !policy.Restricted() || subtitles.IsDir(resolutionPath) || jobs.IsAudioDir(resolutionPath) {
+		return true
+	}
+
+	job, err := h.jobs.Get(ctx, videoID)
+	if err == nil && job.Media != nil {
+		if md, ok := job.Media.Renditions[resolutionPath]; ok && md.Video != nil {
+			return policy.Allows(md.Video.Height, md.Bitrate)
+		}
+	}
+
+	// videos from before the job store were encoded with the default profile
+	profileName := profiles.Default
+	if err == nil && job.Profile != "" {
+		profileName = job.Profile
+	}
+	if profile, ok := profiles.Get(profileName); ok {
+		for _, r := range profile.Renditions {
+			if r.Name == resolutionPath {
+				return policy.Allows(r.Height, int64(r.Bandwidth()))
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/dash"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/probe"
+	"keyflicks_app/internals/profiles"
+	"keyflicks_app/internals/subtitles"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// returned when a video can't be re-transcoded because its original is gone
+var errNoOriginal = errors.New("original not retained")
+
+// handler to show a job merged with what the dispatcher knows about its task
+func (h *StreamHandler) Get_job(c *gin.Context) {
+	jobID := c.Param("id")
+	ctx := c.Request.Context()
+
+	job, err := h.jobs.Get(ctx, jobID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query job"})
+		return
+	}
+
+	response := struct {
+		*jobs.Job
+		Task *dispatch.TaskResult `json:"task,omitempty"`
+	}{Job: job}
+
+	if job.TaskID == "" {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	task, err := h.dispatcher.TaskResult(ctx, job.TaskID)
+	if err != nil {
+		// the job record alone is still useful
+		log.Printf("Failed to read result of task %s for job %s: %v", job.TaskID, jobID, err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	response.Task = task
+
+	if task.Failed() && task.Error != nil {
+		reason := task.Error.Error()
+		if !job.Status.Terminal() {
+			// the worker died before it could report the failure itself
+			if updated, err := h.jobs.Transition(ctx, jobID, jobs.StatusFailed, reason); err == nil {
+				response.Job = updated
+				ev := pendingEvent(updated, jobs.StatusFailed, reason)
+				ev.Error.Code = task.Error.Type
+				if err := h.bus.Publish(ctx, ev); err != nil {
+					log.Printf("Failed to publish failed event for job %s: %v", jobID, err)
+				}
+			}
+		} else if job.Status == jobs.StatusFailed {
+			response.Error = reason
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// handler to cancel a queued or running transcode
+func (h *StreamHandler) Cancel_job(c *gin.Context) {
+	jobID := c.Param("id")
+	ctx := c.Request.Context()
+
+	job, err := h.jobs.Get(ctx, jobID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query job"})
+		return
+	}
+
+	if job.Status.Terminal() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job is already %s", job.Status)})
+		return
+	}
+
+	if job.TaskID != "" {
+		if err := h.dispatcher.Revoke(ctx, job.TaskID, true); err != nil {
+			log.Printf("Failed to revoke task %s of job %s: %v", job.TaskID, jobID, err)
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Failed to revoke the transcode task"})
+			return
+		}
+	}
+
+	job, err = h.jobs.Transition(ctx, jobID, jobs.StatusCancelled, "cancelled by request")
+	if err != nil {
+		// the job finished while we were revoking it
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot cancel job: %v", err)})
+		return
+	}
+
+	// only the run of the pending version is cancelled, a live version stays up
+	if err := h.bus.Publish(ctx, pendingEvent(job, jobs.StatusCancelled, "")); err != nil {
+		log.Printf("Failed to publish cancelled event for job %s: %v", jobID, err)
+	}
+
+	// partial output is removed in the background, a terminated worker may still be flushing uploads
+	go func(prefixes []string) {
+		bgCtx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		for _, prefix := range prefixes {
+			if err := h.S3.DeletePrefix(bgCtx, h.streaming_bucket, prefix); err != nil {
+				log.Printf("Failed to clean up partial output %s: %v", prefix, err)
+				continue
+			}
+			log.Printf("Cleaned up partial output %s", prefix)
+		}
+	}(transcodeOutputs(job))
+
+	if h.keys != nil {
+		if err := h.keys.Delete(ctx, jobID, job.PendingVersion); err != nil {
+			log.Printf("Failed to delete content key of job %s: %v", jobID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// status event of the run producing the pending version of a job
+func pendingEvent(job *jobs.Job, status jobs.Status, reason string) *events.Event {
+	ev := events.NewStatusEvent(job.ID, string(status), reason)
+	ev.PendingVersion = job.PendingVersion
+	return ev
+}
+
+// transcodeOutputs lists what the transcode of the pending version writes.
+// Version 0 shares videos/<id>/ with the subtitle and audio tracks, so only
+// the rendition folders and the files next to them are named, never the whole folder.
+func transcodeOutputs(job *jobs.Job) []string {
+	prefix := job.OutputPrefix(job.PendingVersion)
+
+	profileName := job.Profile
+	if profileName == "" {
+		profileName = profiles.Default
+	}
+	var outputs []string
+	if profile, ok := profiles.Get(profileName); ok {
+		for _, r := range profile.Renditions {
+			outputs = append(outputs, path.Join(prefix, r.Name)+"/")
+		}
+	}
+	return append(outputs,
+		path.Join(prefix, "thumbs")+"/",
+		path.Join(prefix, "master.m3u8"),
+		path.Join(prefix, dash.ManifestFile),
+		path.Join(prefix, jobs.MetadataFile),
+	)
+}
+
+// handler to transcode an existing video again, e.g. with a different profile.
+// The new renditions go to a fresh version folder and are only served once complete.
+func (h *StreamHandler) Retranscode_video(c *gin.Context) {
+	videoID := c.Param("id")
+	ctx := c.Request.Context()
+
+	var body struct {
+		Profile  string   `json:"profile"`
+		PosterAt *float64 `json:"poster_at"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	if body.Profile == "" {
+		body.Profile = profiles.Default
+	}
+	if _, ok := profiles.Get(body.Profile); !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown encoding profile %q", body.Profile)})
+		return
+	}
+	if body.PosterAt != nil && *body.PosterAt < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "poster_at must not be negative"})
+		return
+	}
+
+	job, err := h.jobs.Update(ctx, videoID, func(job *jobs.Job) error {
+		if job.S3Key == "" {
+			return errNoOriginal
+		}
+		if !job.Status.Terminal() {
+			return fmt.Errorf("job is still %s", job.Status)
+		}
+		job.Profile = body.Profile
+		if body.PosterAt != nil {
+			job.PosterAt = body.PosterAt
+		}
+		job.PendingVersion = max(job.Version, job.PendingVersion) + 1
+		return job.Transition(jobs.StatusQueued, "")
+	})
+	if errors.Is(err, errNoOriginal) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No retained original for this video"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot re-transcode video: %v", err)})
+		return
+	}
+
+	job, err = h.dispatchJob(ctx, job)
+	if err != nil {
+		log.Printf("Failed to dispatch re-transcode of %s: %v", videoID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to start video processing job"})
+		return
+	}
+
+	log.Printf("Dispatched re-transcode of %s into %s with profile %s", videoID, job.OutputPrefix(job.PendingVersion), job.Profile)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// announces a freshly queued job and hands it to the worker,
+// on failure the job is marked failed
+func (h *StreamHandler) dispatchJob(ctx context.Context, job *jobs.Job) (*jobs.Job, error) {
+	if err := h.bus.Publish(ctx, pendingEvent(job, jobs.StatusQueued, "")); err != nil {
+		log.Printf("Failed to publish queued event for job %s: %v", job.ID, err)
+	}
+
+	name := job.Profile
+	if name == "" {
+		name = profiles.Default
+	}
+
+	var task *dispatch.Task
+	var err error
+	if profile, ok := profiles.Get(name); !ok {
+		err = fmt.Errorf("unknown encoding profile %q", name)
+	} else {
+		job = h.probeSource(ctx, job)
+		if job.Source != nil {
+			profile = profile.ForSource(job.Source.ShortSide())
+		}
+		req := dispatch.TranscodeRequest{
+			UploadID:     job.ID,
+			S3Key:        job.S3Key,
+			Profile:      profile,
+			OutputPrefix: job.OutputPrefix(job.PendingVersion),
+			PosterAt:     job.PosterAt,
+			Uploader:     job.Uploader,
+			SizeBytes:    job.SizeBytes,
+		}
+		req.Encryption, err = h.encryption(ctx, job)
+		if err == nil {
+			task, err = h.dispatcher.Dispatch(ctx, req)
+		}
+	}
+	if err != nil {
+		reason := fmt.Sprintf("dispatch failed: %v", err)
+		if _, jerr := h.jobs.Transition(ctx, job.ID, jobs.StatusFailed, reason); jerr != nil {
+			log.Printf("Failed to mark job %s as failed: %v", job.ID, jerr)
+		}
+		_ = h.bus.Publish(ctx, pendingEvent(job, jobs.StatusFailed, reason))
+		return nil, err
+	}
+
+	updated, err := h.jobs.Update(ctx, job.ID, func(j *jobs.Job) error {
+		j.TaskID = task.ID
+		j.Queue = task.Queue
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store task id %s for job %s: %v", task.ID, job.ID, err)
+		return job, nil
+	}
+	return updated, nil
+}
+
+// Dispatch_job hands an already queued job to the dispatcher, used by the watchdog for retries
+func (h *StreamHandler) Dispatch_job(ctx context.Context, job *jobs.Job) (*jobs.Job, error) {
+	return h.dispatchJob(ctx, job)
+}
+
+// reads the dimensions of the original so the ladder can skip upscaled renditions.
+// Probing is best effort, without it the full ladder of the profile is used.
+func (h *StreamHandler) probeSource(ctx context.Context, job *jobs.Job) *jobs.Job {
+	if job.Source != nil {
+		return job
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	url, err := h.S3.GeneratePresignedGetUrl(probeCtx, h.pending_bucket, job.S3Key, 5*time.Minute)
+	if err != nil {
+		log.Printf("Failed to presign original of %s for probing: %v", job.ID, err)
+		return job
+	}
+
+	info, err := probe.Probe(probeCtx, url)
+	if err != nil {
+		log.Printf("Failed to probe original of %s, using the full ladder: %v", job.ID, err)
+		return job
+	}
+
+	updated, err := h.jobs.Update(ctx, job.ID, func(j *jobs.Job) error {
+		j.Source = info
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store source info of %s: %v", job.ID, err)
+		job.Source = info
+		return job
+	}
+	return updated
+}
+
+// handler to list the encoding profiles an upload can choose from
+func (h *StreamHandler) List_profiles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"default":  profiles.Default,
+		"profiles": profiles.List(),
+	})
+}
+
+// handler to show how many jobs wait in each broker queue
+func (h *StreamHandler) Queue_status(c *gin.Context) {
+	depths, err := h.dispatcher.QueueDepths(c.Request.Context())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query queue depths"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"queues": depths})
+}
+
+// folder of a rendition relative to videos/<id>/, subtitle tracks are shared by all versions
+func (h *StreamHandler) renditionDir(ctx context.Context, videoID string, resolutionPath string) string {
+	if subtitles.IsDir(resolutionPath) || jobs.IsAudioDir(resolutionPath) {
+		return resolutionPath
+	}
+	return path.Join(h.liveVersionDir(ctx, videoID), resolutionPath)
+}
+
+// folder of the renditions currently served for a video, relative to videos/<id>/
+func (h *StreamHandler) liveVersionDir(ctx context.Context, videoID string) string {
+	job, err := h.jobs.Get(ctx, videoID)
+	if err != nil {
+		// videos from before the job store only have version 0
+		return ""
+	}
+	return jobs.VersionDir(job.Version)
+}
+
+// Job_updated is registered as a jobs.Observer, it drops the cached
+// playlists, preview track and status of a video once new renditions went live
+func (h *StreamHandler) Job_updated(ctx context.Context, job *jobs.Job, ev *events.Event) {
+	// a finished audio track only adds an entry to the master
+	if ev.Type == events.TypeTrack {
+		if ev.Track != nil && ev.Track.State == jobs.TrackReady {
+			h.invalidateCache(ctx,
+				fmt.Sprintf("master:%s:*", job.ID),
+				fmt.Sprintf("playlist:%s:%s:*", job.ID, jobs.AudioDir(ev.Track.Language)),
+			)
+		}
+		return
+	}
+	if ev.Status != string(jobs.StatusReady) {
+		return
+	}
+
+	h.invalidateCache(ctx,
+		fmt.Sprintf("master:%s:*", job.ID),
+		fmt.Sprintf("dash:%s:*", job.ID),
+		fmt.Sprintf("playlist:%s:*", job.ID),
+		fmt.Sprintf("upload_status:%s", job.ID),
+		fmt.Sprintf("sprites:%s:*", job.ID),
+	)
+}
+
+// Load_metadata is registered as a jobs.Observer, once a job is ready it copies the
+// metadata.json the worker wrote next to the master into the job record
+func (h *StreamHandler) Load_metadata(ctx context.Context, job *jobs.Job, ev *events.Event) {
+	if ev.Type != events.TypeStatus || ev.Status != string(jobs.StatusReady) {
+		return
+	}
+
+	key := path.Join(job.OutputPrefix(job.Version), jobs.MetadataFile)
+	body, err := h.S3.GetObject(ctx, h.streaming_bucket, key)
+	if err != nil {
+		log.Printf("No media metadata for job %s: %v", job.ID, err)
+		return
+	}
+	defer body.Close()
+
+	var media probe.MediaInfo
+	if err := json.NewDecoder(body).Decode(&media); err != nil {
+		log.Printf("Malformed media metadata for job %s: %v", job.ID, err)
+		return
+	}
+
+	version := job.Version
+	_, err = h.jobs.Update(ctx, job.ID, func(j *jobs.Job) error {
+		// a newer version went live in the meantime
+		if j.Version != version {
+			return nil
+		}
+		j.Media = &media
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to store media metadata for job %s: %v", job.ID, err)
+	}
+}
+
+// drops the cached responses matching the glob patterns
+func (h *StreamHandler) invalidateCache(ctx context.Context, patterns ...string) {
+	if h.redis == nil {
+		return
+	}
+	for _, pattern := range patterns {
+		if err := h.redis.DeleteMatching(ctx, pattern); err != nil {
+			log.Printf("Failed to invalidate cache %s: %v", pattern, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/keys"
+	"keyflicks_app/internals/signature"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handler handing out the AES-128 content key of a video version.
+// The key URIs in the signed media playlists carry ?v=&exp=&token=,
+// so only viewers that were given a playlist can decrypt the segments.
+func (h *StreamHandler) Get_key(c *gin.Context) {
+	videoID := c.Param("video_id")
+
+	if h.keys == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Segment encryption is disabled"})
+		return
+	}
+
+	version, err1 := strconv.Atoi(c.Query("v"))
+	expires, err2 := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err1 != nil || err2 != nil || !h.keys.Verify(videoID, version, expires, c.Query("token")) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid key token"})
+		return
+	}
+	// same status nginx answers expired segment links with
+	if time.Now().Unix() > expires {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "Key token expired"})
+		return
+	}
+
+	key, err := h.keys.Get(c.Request.Context(), videoID, version)
+	if errors.Is(err, keys.ErrNoKey) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load content key of %s/%d: %v", videoID, version, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load key"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/octet-stream", key)
+}
+
+// content key of the version a job is about to produce, nil when encryption is off
+func (h *StreamHandler) encryption(ctx context.Context, job *jobs.Job) (*dispatch.Encryption, error) {
+	if h.keys == nil {
+		return nil, nil
+	}
+	key, err := h.keys.Ensure(ctx, job.ID, job.PendingVersion)
+	if err != nil {
+		return nil, fmt.Errorf("content key: %w", err)
+	}
+	return &dispatch.Encryption{
+		Key:    key,
+		KeyURI: fmt.Sprintf("/api/keys/%s?v=%d", job.ID, job.PendingVersion),
+	}, nil
+}
+
+// keyURI returns the rewrite of the EXT-X-KEY URIs of a media playlist,
+// the version is taken from the URI the worker wrote and a token valid until expires is added
+func (h *StreamHandler) keyURI(videoID string, urls signature.URLs) func(uri string, expires int64) string {
+	return func(uri string, expires int64) string {
+		if h.keys == nil {
+			return uri
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return uri
+		}
+		version, err := strconv.Atoi(u.Query().Get("v"))
+		if err != nil {
+			return uri
+		}
+		return urls.API(fmt.Sprintf("/keys/%s?v=%d&exp=%d&token=%s", videoID, version, expires, h.keys.Token(videoID, version, expires)))
+	}
+}
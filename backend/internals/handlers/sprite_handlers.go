@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"keyflicks_app/internals/signature"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handler to serve the WebVTT scrub preview track of a video,
+// every sprite sheet reference in it is signed like the segments
+func (h *StreamHandler) Sprite_track(c *gin.Context) {
+	videoID := c.Param("video_id")
+	ctx := c.Request.Context()
+
+	const REFRESH_THRESHOLD_SECONDS = 25 * 60
+	cacheTTLSeconds := h.TTL + 300
+
+	urls := h.urlsFor(c)
+	cacheKey := fmt.Sprintf("sprites:%s:%s", videoID, urls.CacheKey())
+	now := time.Now().Unix()
+
+	type cacheData struct {
+		Track     string `json:"track"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+
+	if h.redis != nil {
+		if cachedStr, err := h.redis.Get(ctx, cacheKey); err == nil && cachedStr != "" {
+			var cd cacheData
+			if err := json.Unmarshal([]byte(cachedStr), &cd); err == nil && cd.ExpiresAt-now > REFRESH_THRESHOLD_SECONDS {
+				c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(cd.Track))
+				return
+			}
+		}
+	}
+
+	thumbsDir := path.Join(h.liveVersionDir(ctx, videoID), "thumbs")
+	body, err := h.S3.GetObject(ctx, h.streaming_bucket, path.Join("videos", videoID, thumbsDir, "sprites.vtt"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No preview track for this video"})
+		return
+	}
+	defer body.Close()
+
+	vttBytes, err := io.ReadAll(body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to read preview track"})
+		return
+	}
+
+	expires := now + int64(h.TTL)
+	rewritten := signature.RewriteVTT(string(vttBytes), videoID, thumbsDir, expires, h.uri_secret, urls)
+
+	go func(data cacheData) {
+		bgCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		b, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		if h.redis != nil {
+			_ = h.redis.Set(bgCtx, cacheKey, string(b), cacheTTLSeconds)
+		}
+	}(cacheData{
+		Track:     rewritten,
+		ExpiresAt: expires,
+	})
+
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(rewritten))
+}
@@ -3,16 +3,28 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"keyflicks_app/internals/admission"
+	"keyflicks_app/internals/auth"
 	"keyflicks_app/internals/cache"
-	"keyflicks_app/internals/celery"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/entitlements"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/keys"
+	"keyflicks_app/internals/probe"
+	"keyflicks_app/internals/profiles"
 	"keyflicks_app/internals/s3_store"
 	"keyflicks_app/internals/signature"
+	"keyflicks_app/internals/webhooks"
 	"log"
+	"math"
 	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -23,25 +35,55 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	// events replayed to SSE clients that connect without a Last-Event-ID
+	sseReplayCount = 20
+	// interval of the SSE comment lines that keep idle connections open
+	sseHeartbeatInterval = 15 * time.Second
+)
+
+var (
+	// returned when an upload arrives for a job that was cancelled before
+	errJobCancelled = errors.New("job was cancelled")
+	// returned when the notification of an upload that was queued before is delivered again
+	errAlreadyQueued = errors.New("upload was queued already")
+)
+
 type StreamHandler struct {
 	S3               *s3_store.S3Store
 	redis            *cache.RedisDB
-	celery           *celery.Celery
+	dispatcher       dispatch.Dispatcher
+	jobs             *jobs.Store
+	bus              *events.Bus
+	admission        *admission.Controller
+	webhooks         *webhooks.Notifier
+	keys             *keys.Store // nil when segments are not encrypted
+	urls             *signature.URLSet
+	entitlements     entitlements.Resolver // nil when every viewer may play every rendition
 	uri_secret       string
+	position_expiry  bool // segments expire TTL after their start time instead of TTL after the request
 	pending_bucket   string
 	streaming_bucket string
 	TTL              int
 }
 
-func NewStreamHandler(s3 *s3_store.S3Store, rds *cache.RedisDB, cel *celery.Celery, uri_sec string, pend_bucket string, stream_bucket string, exp int) *StreamHandler {
+func NewStreamHandler(s3 *s3_store.S3Store, rds *cache.RedisDB, dispatcher dispatch.Dispatcher, job_store *jobs.Store, bus *events.Bus, adm *admission.Controller, notifier *webhooks.Notifier, key_store *keys.Store, urls *signature.URLSet, policies entitlements.Resolver, uri_sec string, pend_bucket string, stream_bucket string, exp int, position_expiry bool) *StreamHandler {
 	return &StreamHandler{
 		S3:               s3,
 		redis:            rds,
-		celery:           cel,
+		dispatcher:       dispatcher,
+		jobs:             job_store,
+		bus:              bus,
+		admission:        adm,
+		webhooks:         notifier,
+		keys:             key_store,
+		urls:             urls,
+		entitlements:     policies,
 		uri_secret:       uri_sec,
 		pending_bucket:   pend_bucket,
 		streaming_bucket: stream_bucket,
 		TTL:              exp,
+		position_expiry:  position_expiry,
 	}
 }
 
@@ -50,6 +92,54 @@ func (h *StreamHandler) Generate_upload_url(c *gin.Context) {
 
 	filename := c.Param("filename")
 
+	profile := c.DefaultQuery("profile", profiles.Default)
+	if _, ok := profiles.Get(profile); !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown encoding profile %q", profile)})
+		return
+	}
+
+	// optional url notified when the video is ready or failed
+	callbackURL := c.Query("callback_url")
+	if callbackURL != "" {
+		if err := h.webhooks.ValidateURL(c.Request.Context(), callbackURL); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid callback_url: %v", err)})
+			return
+		}
+	}
+
+	// optional second of the video to take the poster frame from
+	var posterAt *float64
+	if v := c.Query("poster_at"); v != "" {
+		at, err := strconv.ParseFloat(v, 64)
+		if err != nil || at < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "poster_at must be a non-negative number of seconds"})
+			return
+		}
+		posterAt = &at
+	}
+
+	// refuse new uploads while the workers are too far behind
+	var estimatedWait time.Duration
+	if h.admission != nil {
+		decision, err := h.admission.Check(c.Request.Context())
+		if err != nil {
+			// the backlog is unknown, better to accept than to lock everyone out
+			log.Printf("Admission check failed, accepting upload: %v", err)
+		} else if !decision.Admit {
+			retryAfter := int(math.Ceil(decision.RetryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error":                  "Too many videos are waiting to be processed, try again later",
+				"backlog":                decision.Backlog,
+				"estimated_wait_seconds": int(decision.EstimatedWait.Seconds()),
+				"retry_after_seconds":    retryAfter,
+			})
+			return
+		} else {
+			estimatedWait = decision.EstimatedWait
+		}
+	}
+
 	id := uuid.New().String()
 	video_id := strings.ReplaceAll(id, "-", "")
 
@@ -60,6 +150,24 @@ func (h *StreamHandler) Generate_upload_url(c *gin.Context) {
 
 	s3_key := fmt.Sprintf("pending/%s.%s", video_id, ext)
 
+	// callbacks are always signed, anonymous uploads get a secret of their own
+	var callbackSecret string
+	if callbackURL != "" {
+		secret, derived, err := h.webhooks.CallbackSecret(c.Request.Context(), auth.ClientID(c), video_id)
+		if errors.Is(err, webhooks.ErrNoSecret) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "callback_url needs a registered webhook (PUT /api/webhooks) to sign the callbacks with"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading the callback secret for %s: %v", video_id, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up the callback"})
+			return
+		}
+		if derived {
+			callbackSecret = secret
+		}
+	}
+
 	content_type := mime.TypeByExtension("." + ext)
 
 	if content_type == "" {
@@ -80,32 +188,57 @@ func (h *StreamHandler) Generate_upload_url(c *gin.Context) {
 		return
 	}
 
+	job := jobs.NewJob(video_id, s3_key, profile)
+	job.Uploader = auth.ClientID(c)
+	job.CallbackURL = callbackURL
+	job.PosterAt = posterAt
+	if err := h.jobs.Create(c.Request.Context(), job); err != nil {
+		log.Printf("Error creating job record for %s: %v", video_id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to create video processing job"})
+		return
+	}
+
+	response := gin.H{
+		"presigned_url":          publicUploadURL(c, local_presigned_url),
+		"video_id":               video_id,
+		"s3_key":                 s3_key,
+		"profile":                profile,
+		"estimated_wait_seconds": int(estimatedWait.Seconds()),
+	}
+	// only shown here, it verifies the X-Keyflicks-Signature of the callback
+	if callbackSecret != "" {
+		response["callback_secret"] = callbackSecret
+	}
+	c.JSON(http.StatusOK, response)
+
+}
+
+// points a presigned minio url at the host the client reached us through
+func publicUploadURL(c *gin.Context, local_presigned_url string) string {
 	proto := c.GetHeader("x-forwarded-proto")
 	if proto == "" {
 		proto = "http"
 	}
 
 	host := c.GetHeader("host")
-
 	if host == "" {
-		c.JSON(http.StatusOK, gin.H{
-			"presigned_url": local_presigned_url,
-			"video_id":      video_id,
-			"s3_key":        s3_key,
-		})
-		return
+		return local_presigned_url
 	}
 
 	newBaseURL := fmt.Sprintf("%s://%s", proto, host)
+	return strings.Replace(local_presigned_url, "http://localhost:9000", newBaseURL, -1)
+}
 
-	public_presigned_url := strings.Replace(local_presigned_url, "http://localhost:9000", newBaseURL, -1)
-
-	c.JSON(http.StatusOK, gin.H{
-		"presigned_url": public_presigned_url,
-		"video_id":      video_id,
-		"s3_key":        s3_key,
-	})
+// expiry of the segment URLs signed into a playlist handed out at now
+func (h *StreamHandler) segmentExpiry(now int64) signature.Expiry {
+	return signature.Expiry{Issued: now, TTL: int64(h.TTL), PositionAware: h.position_expiry}
+}
 
+// URL settings of the deployment the request was made to, white-label hosts
+// are told apart by the Host nginx passes on. X-Forwarded-Host comes straight
+// from the client and would let it pick the settings of another host.
+func (h *StreamHandler) urlsFor(c *gin.Context) signature.URLs {
+	return h.urls.For(c.Request.Host)
 }
 
 // webhook handler
@@ -135,6 +268,8 @@ func (h *StreamHandler) Handle_s3_event(c *gin.Context) {
 	s3Data, _ := record["s3"].(map[string]interface{})
 	objectData, _ := s3Data["object"].(map[string]interface{})
 	encodedS3Key, _ := objectData["key"].(string)
+	sizeBytes, _ := objectData["size"].(float64)
+	etag, _ := objectData["eTag"].(string)
 
 	// URL-decode the key
 	s3Key, err := url.QueryUnescape(encodedS3Key)
@@ -157,8 +292,46 @@ func (h *StreamHandler) Handle_s3_event(c *gin.Context) {
 	filename := parts[1]
 	uploadID := strings.Split(filename, ".")[0]
 
-	err = h.celery.DispatchVideoTranscodeTask(c.Request.Context(), uploadID, s3Key)
+	ctx := c.Request.Context()
+
+	// extra audio tracks are uploaded as "audio/UPLOAD_ID/LANG.m4a"
+	if parts[0] == audioUploadPrefix {
+		h.handleAudioUpload(c, s3Key, etag)
+		return
+	}
+
+	job, err := h.jobs.Update(ctx, uploadID, func(job *jobs.Job) error {
+		if job.Status == jobs.StatusCancelled {
+			return errJobCancelled
+		}
+		// S3 delivers at least once, only the first notification of an upload queues it.
+		// Re-transcodes are dispatched by Retranscode_video, never by a replayed event.
+		if job.Status != jobs.StatusAwaitingUpload {
+			return errAlreadyQueued
+		}
+		job.S3Key = s3Key
+		job.SizeBytes = int64(sizeBytes)
+		job.PendingVersion = 0
+		return job.Transition(jobs.StatusQueued, "")
+	})
+	if errors.Is(err, errJobCancelled) {
+		// acknowledged so the notification is not retried
+		log.Printf("Ignoring upload %s, the job was cancelled", uploadID)
+		c.Status(http.StatusOK)
+		return
+	}
+	if errors.Is(err, errAlreadyQueued) {
+		log.Printf("Ignoring duplicate notification for upload %s", uploadID)
+		c.Status(http.StatusOK)
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to queue job for upload %s: %v", uploadID, err)
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot queue video processing job: %v", err)})
+		return
+	}
+
+	if _, err := h.dispatchJob(ctx, job); err != nil {
 		log.Printf("CRITICAL: Failed to dispatch Celery task for upload %s: %v", uploadID, err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to start video processing job"})
 		return
@@ -179,50 +352,94 @@ func (h *StreamHandler) Get_status(c *gin.Context) {
 		return
 	}
 
+	ctx := c.Request.Context()
+	// subscribing before reading the history so no event can slip in between
+	pubsub := h.redis.Subscribe(ctx, events.Channel(upload_id))
+	// Ensure the subscription is closed when the handler exits
+	defer pubsub.Close()
+
+	job, err := h.jobs.Get(ctx, upload_id)
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload ID not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query upload status"})
+		return
+	}
+
+	// Resume after the last event the client saw, or replay the recent ones
+	var replay []*events.Event
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if events.ValidID(lastEventID) {
+		replay, err = h.bus.Since(ctx, upload_id, lastEventID)
+	} else {
+		lastEventID = ""
+		replay, err = h.bus.Recent(ctx, upload_id, sseReplayCount)
+	}
+	if err != nil {
+		log.Printf("SSE: Failed to load event history for upload %s: %v", upload_id, err)
+		replay = nil
+	}
+
+	// the history may have expired, the job record always knows the latest status
+	if len(replay) == 0 || (job.Status.Terminal() && !replay[len(replay)-1].Terminal()) {
+		replay = append(replay, pendingEvent(job, job.Status, job.Error))
+	}
+
 	// Setting the headers needed for Server-Sent Events
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 
-	channel := fmt.Sprintf("job_status_%s", upload_id)
-
-	ctx := c.Request.Context()
-	pubsub := h.redis.Subscribe(ctx, channel)
-	// Ensure the subscription is closed when the handler exits
-	defer pubsub.Close()
+	for _, ev := range replay {
+		if ev.ID != "" {
+			lastEventID = ev.ID
+		}
+		if err := events.WriteSSE(c.Writer, ev); err != nil {
+			return
+		}
+		if ev.Terminal() {
+			// the job already finished, nothing will be published anymore
+			c.Writer.Flush()
+			return
+		}
+	}
+	c.Writer.Flush()
 
 	// Use a channel to receive messages from Redis
 	redisChan := pubsub.Channel()
 
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case msg := <-redisChan:
 			// A message was received from Redis
-			status := msg.Payload
-			log.Printf("SSE: Got status '%s' for upload %s", status, upload_id)
-
-			// The nested JSON structure from your Python code
-			type sseInnerData struct {
-				Status string `json:"status"`
-			}
-			type sseOuterData struct {
-				Data sseInnerData `json:"data"`
+			ev, err := events.Parse(upload_id, msg.Payload)
+			if err != nil {
+				log.Printf("SSE: Dropping invalid event for upload %s: %v", upload_id, err)
+				return true
 			}
 
-			// Create and marshal the data to JSON
-			ssePayload := sseOuterData{Data: sseInnerData{Status: status}}
-			jsonBytes, _ := json.Marshal(ssePayload)
+			// already sent as part of the replay
+			if ev.ID != "" && lastEventID != "" && events.CompareIDs(ev.ID, lastEventID) <= 0 {
+				return true
+			}
+			log.Printf("SSE: Got %s event '%s' for upload %s", ev.Type, ev.Status, upload_id)
 
-			// Write the SSE-formatted message to the client
-			// The format is "data: <json-payload>\n\n"
-			fmt.Fprintf(w, "data: %s\n\n", string(jsonBytes))
+			if err := events.WriteSSE(w, ev); err != nil {
+				return false
+			}
 
 			// Flush the writer to ensure the message is sent immediately
 			c.Writer.Flush()
 
 			// If the job is done, close the connection
-			if status == "ready" || status == "failed" {
+			if ev.Terminal() {
 				log.Printf("SSE: Closing connection for upload %s", upload_id)
 				return false // false = close stream
 			}
@@ -230,6 +447,13 @@ func (h *StreamHandler) Get_status(c *gin.Context) {
 			// Keep the connection open for the next message
 			return true // true = continue stream
 
+		case <-heartbeat.C:
+			if err := events.WriteHeartbeat(w); err != nil {
+				return false
+			}
+			c.Writer.Flush()
+			return true
+
 		case <-ctx.Done():
 			// The client has disconnected
 			log.Printf("SSE: Client disconnected for upload %s", upload_id)
@@ -246,7 +470,14 @@ func (h *StreamHandler) Sign_segments(c *gin.Context) {
 	const REFRESH_THRESHOLD_SECONDS = 25 * 60
 	cacheTTLSeconds := h.TTL + 300
 
-	cacheKey := fmt.Sprintf("playlist:%s:%s", videoID, resolutionPath)
+	// renditions above the plan of the caller are refused even when it knows their URL
+	if !h.renditionAllowed(c.Request.Context(), videoID, resolutionPath, h.policyFor(c)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "Rendition not included in your plan"})
+		return
+	}
+
+	urls := h.urlsFor(c)
+	cacheKey := fmt.Sprintf("playlist:%s:%s:%s", videoID, resolutionPath, urls.CacheKey())
 	now := time.Now().Unix()
 
 	type cacheData struct {
@@ -270,8 +501,9 @@ func (h *StreamHandler) Sign_segments(c *gin.Context) {
 		}
 	}
 
-	// Cache MISS or stale: fetch original playlist from S3
-	s3Key := fmt.Sprintf("videos/%s/%s/playlist.m3u8", videoID, resolutionPath)
+	// Cache MISS or stale: fetch original playlist of the live version from S3
+	renditionPath := h.renditionDir(c.Request.Context(), videoID, resolutionPath)
+	s3Key := fmt.Sprintf("videos/%s/%s/playlist.m3u8", videoID, renditionPath)
 	body, err := h.S3.GetObject(c.Request.Context(), h.streaming_bucket, s3Key)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"detail": fmt.Sprintf("Failed to fetch master playlist: %v", err)})
@@ -287,8 +519,13 @@ func (h *StreamHandler) Sign_segments(c *gin.Context) {
 	playlistContent := string(playlistBytes)
 
 	// Rewrite with fresh signatures
-	expires := now + int64(h.TTL)
-	rewritten := signature.RewritePlaylist(playlistContent, videoID, resolutionPath, expires, h.uri_secret)
+	expiry := h.segmentExpiry(now)
+	rewritten, err := signature.RewritePlaylist(playlistContent, videoID, renditionPath, expiry, h.uri_secret, urls, h.keyURI(videoID, urls))
+	if err != nil {
+		log.Printf("Malformed playlist %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"detail": "Malformed playlist"})
+		return
+	}
 
 	// Background cache update (decoupled from request context)
 	go func(data cacheData) {
@@ -303,8 +540,9 @@ func (h *StreamHandler) Sign_segments(c *gin.Context) {
 			_ = h.redis.Set(bgCtx, cacheKey, string(b), cacheTTLSeconds)
 		}
 	}(cacheData{
-		Playlist:  rewritten,
-		ExpiresAt: expires,
+		Playlist: rewritten,
+		// the first segment expires soonest
+		ExpiresAt: expiry.At(0),
 	})
 
 	// Respond with the rewritten playlist
@@ -316,7 +554,9 @@ func (h *StreamHandler) Modified_master(c *gin.Context) {
 
 	videoId := c.Param("video_id")
 
-	cache_key := fmt.Sprintf("master:%s", videoId)
+	urls := h.urlsFor(c)
+	policy := h.policyFor(c)
+	cache_key := fmt.Sprintf("master:%s:%s:%s", videoId, urls.CacheKey(), policy.CacheKey())
 
 	type cacheData struct {
 		Playlist string `json:"playlist"`
@@ -335,7 +575,7 @@ func (h *StreamHandler) Modified_master(c *gin.Context) {
 	}
 
 	//cache miss happened
-	s3Key := fmt.Sprintf("videos/%s/master.m3u8", videoId)
+	s3Key := path.Join("videos", videoId, h.liveVersionDir(c.Request.Context(), videoId), "master.m3u8")
 	body, err := h.S3.GetObject(c.Request.Context(), h.streaming_bucket, s3Key)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"detail": fmt.Sprintf("Failed to fetch master playlist: %v", err)})
@@ -350,7 +590,28 @@ func (h *StreamHandler) Modified_master(c *gin.Context) {
 	}
 	playlistContent := string(playlistBytes)
 
-	rewritten_playlist := signature.RewriteMasterPlaylist(playlistContent, videoId)
+	rewritten_playlist, err := signature.RewriteMasterPlaylist(playlistContent, videoId, urls)
+
+	// extra audio languages and uploaded caption tracks
+	if job, jobErr := h.jobs.Get(c.Request.Context(), videoId); err == nil && jobErr == nil {
+		rewritten_playlist, err = signature.AddMediaGroup(rewritten_playlist, audioRenditions(videoId, job.AudioTracks, urls))
+		if err == nil {
+			rewritten_playlist, err = signature.AddMediaGroup(rewritten_playlist, subtitleRenditions(videoId, job.Subtitles, urls))
+		}
+	}
+	// variants above the plan of the caller
+	if err == nil && policy.Restricted() {
+		rewritten_playlist, err = signature.FilterVariants(rewritten_playlist, variantFilter(policy))
+	}
+	if errors.Is(err, signature.ErrNoRenditions) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "No rendition included in your plan"})
+		return
+	}
+	if err != nil {
+		log.Printf("Malformed master playlist %s: %v", s3Key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"detail": "Malformed master playlist"})
+		return
+	}
 
 	// Background cache update (decoupled from request context)
 	go func(data cacheData) {
@@ -373,49 +634,142 @@ func (h *StreamHandler) Modified_master(c *gin.Context) {
 
 }
 
-// handler function to see the status of video using video id
+// handler function to see the status of video using video id.
+// The status is the one of the live version, a queued or running
+// re-transcode is reported separately as pending_job.
 func (h *StreamHandler) Stream_status(c *gin.Context) {
 	uploadID := c.Param("upload_id")
-	cacheKey := fmt.Sprintf("upload_status:%s", uploadID)
+	ctx := c.Request.Context()
+
+	type pendingJob struct {
+		Version    int         `json:"version"`
+		Status     jobs.Status `json:"status"`
+		Profile    string      `json:"profile,omitempty"`
+		Stage      string      `json:"stage,omitempty"`
+		Percent    float64     `json:"percent"`
+		Error      string      `json:"error,omitempty"`
+		QueuedAt   *time.Time  `json:"queued_at,omitempty"`
+		StartedAt  *time.Time  `json:"started_at,omitempty"`
+		FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	}
 
-	// The struct for both the cache and the final API response.
-	// Using `int` for resolutions to allow for proper sorting.
 	type responseData struct {
-		UploadID             string `json:"upload_id"`
-		Status               string `json:"status"`
-		AvailableResolutions []int  `json:"available_resolutions"`
+		UploadID             string      `json:"upload_id"`
+		Status               jobs.Status `json:"status"`
+		Version              int         `json:"version"`
+		Queue                string      `json:"queue,omitempty"`
+		AvailableResolutions []int       `json:"available_resolutions"`
+		// duration, codecs and sizes of the original and the renditions
+		Metadata    *probe.MediaInfo `json:"metadata,omitempty"`
+		Error       string           `json:"error,omitempty"`
+		CreatedAt   *time.Time       `json:"created_at,omitempty"`
+		UpdatedAt   *time.Time       `json:"updated_at,omitempty"`
+		QueuedAt    *time.Time       `json:"queued_at,omitempty"`
+		StartedAt   *time.Time       `json:"started_at,omitempty"`
+		FinishedAt  *time.Time       `json:"finished_at,omitempty"`
+		PublishedAt *time.Time       `json:"published_at,omitempty"`
+		// the latest transcode when it did not produce the live version (yet)
+		PendingJob *pendingJob `json:"pending_job,omitempty"`
+	}
+
+	// 1. The job record is the source of truth for the status.
+	job, err := h.jobs.Get(ctx, uploadID)
+	if err != nil && !errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query upload status"})
+		return
+	}
+
+	response := responseData{
+		UploadID:             uploadID,
+		AvailableResolutions: []int{},
+	}
+
+	if job != nil {
+		response.Status = job.Status
+		response.Version = job.Version
+		response.Queue = job.Queue
+		response.Error = job.Error
+		response.Metadata = job.Media
+		response.CreatedAt = &job.CreatedAt
+		response.UpdatedAt = &job.UpdatedAt
+		response.QueuedAt = job.QueuedAt
+		response.StartedAt = job.StartedAt
+		response.FinishedAt = job.FinishedAt
+		response.PublishedAt = job.PublishedAt
+
+		if job.Status != jobs.StatusReady {
+			response.PendingJob = &pendingJob{
+				Version:    job.PendingVersion,
+				Status:     job.Status,
+				Profile:    job.Profile,
+				Stage:      job.Stage,
+				Percent:    job.Percent,
+				Error:      job.Error,
+				QueuedAt:   job.QueuedAt,
+				StartedAt:  job.StartedAt,
+				FinishedAt: job.FinishedAt,
+			}
+		}
+
+		if !job.Live() {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		// the earlier renditions are still served
+		response.Status = jobs.StatusReady
+		response.Error = ""
+	}
+
+	// 2. A version is live (or the video predates the job store), look up its renditions.
+	resolutions, found, err := h.availableResolutions(ctx, uploadID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query upload status"})
+		return
+	}
+
+	if job == nil {
+		// videos transcoded before job records existed only have their S3 objects
+		if !found {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Upload ID not found"})
+			return
+		}
+		response.Status = jobs.StatusReady
+	}
+
+	response.AvailableResolutions = resolutions
+	c.JSON(http.StatusOK, response)
+}
+
+// lists the renditions of a transcoded video, found is false when there is no master playlist
+func (h *StreamHandler) availableResolutions(ctx context.Context, uploadID string) ([]int, bool, error) {
+	cacheKey := fmt.Sprintf("upload_status:%s", uploadID)
+
+	type cacheData struct {
+		AvailableResolutions []int `json:"available_resolutions"`
 	}
 
 	// 1. Try to fetch from the cache first.
 	if h.redis != nil {
-		if cachedStr, err := h.redis.Get(c.Request.Context(), cacheKey); err == nil && cachedStr != "" {
-			var data responseData
+		if cachedStr, err := h.redis.Get(ctx, cacheKey); err == nil && cachedStr != "" {
+			var data cacheData
 			if err := json.Unmarshal([]byte(cachedStr), &data); err == nil {
 				log.Printf("Cache HIT for upload_id: %s", uploadID)
-				c.JSON(http.StatusOK, data)
-				return
+				return data.AvailableResolutions, true, nil
 			}
 		}
 	}
 
 	log.Printf("Cache MISS for upload_id: %s", uploadID)
 
-	// 2. Cache MISS: Query S3 for the list of objects.
+	// 2. Cache MISS: Query S3 for the list of objects of the live version.
 	// The trailing slash is important for listing objects within the "folder".
-	prefix := fmt.Sprintf("videos/%s/", uploadID)
+	prefix := path.Join("videos", uploadID, h.liveVersionDir(ctx, uploadID)) + "/"
 
-	objects, err := h.S3.ListObjects(c.Request.Context(), h.streaming_bucket, prefix)
+	objects, err := h.S3.ListObjects(ctx, h.streaming_bucket, prefix)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query upload status"})
-		return
+		return nil, false, err
 	}
 
-	if len(objects) == 0 {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Upload ID not found"})
-		return
-	}
-
-	// 3. Determine status based on the files found.
 	// A map is the Go equivalent of Python's set for efficient lookups.
 	keys := make(map[string]bool)
 	for _, obj := range objects {
@@ -423,42 +777,33 @@ func (h *StreamHandler) Stream_status(c *gin.Context) {
 		keys[strings.TrimPrefix(*obj.Key, prefix)] = true
 	}
 
-	status := "processing"
 	resolutions := []int{}
+	if !keys["master.m3u8"] {
+		return resolutions, false, nil
+	}
 
-	if keys["master.m3u8"] {
-		status = "ready"
-		for k := range keys {
-			// e.g., "360p/playlist.m3u8"
-			if strings.HasSuffix(k, "playlist.m3u8") && strings.Contains(k, "/") {
-				resStr := strings.Split(k, "/")[0] // "360p"
-				if strings.HasSuffix(resStr, "p") {
-					// Convert "360p" -> "360" -> 360 (int)
-					if resInt, err := strconv.Atoi(strings.TrimSuffix(resStr, "p")); err == nil {
-						resolutions = append(resolutions, resInt)
-					}
+	for k := range keys {
+		// e.g., "360p/playlist.m3u8", newer versions in nested folders are skipped
+		if parts := strings.Split(k, "/"); len(parts) == 2 && parts[1] == "playlist.m3u8" {
+			resStr := parts[0] // "360p"
+			if strings.HasSuffix(resStr, "p") {
+				// Convert "360p" -> "360" -> 360 (int)
+				if resInt, err := strconv.Atoi(strings.TrimSuffix(resStr, "p")); err == nil {
+					resolutions = append(resolutions, resInt)
 				}
 			}
 		}
 	}
-
-	// 4. Construct the final response.
 	sort.Ints(resolutions) // Equivalent to Python's sorted()
-	finalResponse := responseData{
-		UploadID:             uploadID,
-		Status:               status,
-		AvailableResolutions: resolutions,
-	}
 
-	// 5. Update the cache in the background.
-	// This is the Go equivalent of background_tasks.add_task.
+	// 3. Update the cache in the background.
+	// A background task should have its own context that isn't tied to the request.
 	go func() {
-		jsonData, err := json.Marshal(finalResponse)
+		jsonData, err := json.Marshal(cacheData{AvailableResolutions: resolutions})
 		if err != nil {
 			log.Printf("Background cache update failed (marshal): %v", err)
 			return
 		}
-		// A background task should have its own context that isn't tied to the request.
 		bgCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -469,7 +814,5 @@ func (h *StreamHandler) Stream_status(c *gin.Context) {
 		}
 	}()
 
-	// 6. Return the final response to the client.
-	c.JSON(http.StatusOK, finalResponse)
-
+	return resolutions, true, nil
 }
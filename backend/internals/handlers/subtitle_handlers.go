@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/profiles"
+	"keyflicks_app/internals/signature"
+	"keyflicks_app/internals/subtitles"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// largest subtitle file accepted
+const maxSubtitleBytes = 5 << 20
+
+// handler to attach an SRT or WebVTT caption track to a video.
+// The file is sent as the "file" field of a multipart form or as the raw body,
+// ?lang= is required, ?name= and ?default=true are optional.
+func (h *StreamHandler) Upload_subtitles(c *gin.Context) {
+	videoID := c.Param("id")
+	ctx := c.Request.Context()
+
+	lang := c.Query("lang")
+	if !subtitles.ValidLanguage(lang) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "lang must be a language tag like en or pt-BR"})
+		return
+	}
+	name := c.DefaultQuery("name", lang)
+	isDefault := c.Query("default") == "true"
+
+	job, err := h.jobs.Get(ctx, videoID)
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query video"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSubtitleBytes)
+	var src io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, _, err := c.Request.FormFile("file")
+		if err != nil {
+			abortSubtitleRead(c, err, "Missing subtitle file")
+			return
+		}
+		defer file.Close()
+		src = file
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		abortSubtitleRead(c, err, "Failed to read subtitle file")
+		return
+	}
+
+	track, err := subtitles.ToVTT(data, segmentStartPTS(job))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid subtitle file: %v", err)})
+		return
+	}
+
+	// the single segment has to cover the whole video
+	duration := track.Duration
+	if job.Source != nil && job.Source.Duration > duration {
+		duration = job.Source.Duration
+	}
+
+	prefix := path.Join("videos", videoID, subtitles.Dir(lang))
+	if err := h.S3.PutObject(ctx, h.streaming_bucket, path.Join(prefix, "subtitles.vtt"), strings.NewReader(track.VTT), "text/vtt"); err != nil {
+		log.Printf("Failed to store subtitles of %s: %v", videoID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to store subtitles"})
+		return
+	}
+	playlist := subtitles.Playlist("subtitles.vtt", duration)
+	if err := h.S3.PutObject(ctx, h.streaming_bucket, path.Join(prefix, "playlist.m3u8"), strings.NewReader(playlist), "application/vnd.apple.mpegurl"); err != nil {
+		log.Printf("Failed to store subtitle playlist of %s: %v", videoID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to store subtitles"})
+		return
+	}
+
+	job, err = h.jobs.Update(ctx, videoID, func(j *jobs.Job) error {
+		tracks := make([]jobs.TextTrack, 0, len(j.Subtitles)+1)
+		for _, t := range j.Subtitles {
+			if t.Language == lang {
+				continue
+			}
+			if isDefault {
+				t.Default = false
+			}
+			tracks = append(tracks, t)
+		}
+		j.Subtitles = append(tracks, jobs.TextTrack{Language: lang, Name: name, Default: isDefault})
+		return nil
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subtitle track"})
+		return
+	}
+
+	h.invalidateCache(ctx,
+		fmt.Sprintf("master:%s:*", videoID),
+		fmt.Sprintf("playlist:%s:%s:*", videoID, subtitles.Dir(lang)),
+	)
+	c.JSON(http.StatusCreated, gin.H{"subtitles": job.Subtitles})
+}
+
+// answers a failed read of the upload, 413 when it hit maxSubtitleBytes
+func abortSubtitleRead(c *gin.Context, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Subtitle files are limited to %d bytes", maxSubtitleBytes)})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": message})
+}
+
+// PTS the first segment of the video starts at, which depends on the
+// segment container of its profile. The tracks are shared by all versions,
+// the latest profile of the video decides
+func segmentStartPTS(job *jobs.Job) int64 {
+	name := job.Profile
+	if name == "" {
+		name = profiles.Default
+	}
+	if profile, ok := profiles.Get(name); ok && profile.FMP4() {
+		return subtitles.FMP4StartPTS
+	}
+	return subtitles.TSStartPTS
+}
+
+// handler to remove the caption track of one language
+func (h *StreamHandler) Delete_subtitles(c *gin.Context) {
+	videoID := c.Param("id")
+	lang := c.Param("lang")
+	ctx := c.Request.Context()
+
+	if !subtitles.ValidLanguage(lang) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid language tag"})
+		return
+	}
+
+	found := false
+	job, err := h.jobs.Update(ctx, videoID, func(j *jobs.Job) error {
+		tracks := j.Subtitles[:0]
+		for _, t := range j.Subtitles {
+			if t.Language == lang {
+				found = true
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		if !found {
+			return jobs.ErrNotFound
+		}
+		j.Subtitles = tracks
+		return nil
+	})
+	if errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No subtitles in this language"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove subtitle track"})
+		return
+	}
+
+	h.invalidateCache(ctx,
+		fmt.Sprintf("master:%s:*", videoID),
+		fmt.Sprintf("playlist:%s:%s:*", videoID, subtitles.Dir(lang)),
+	)
+	if err := h.S3.DeletePrefix(ctx, h.streaming_bucket, path.Join("videos", videoID, subtitles.Dir(lang))+"/"); err != nil {
+		log.Printf("Failed to delete subtitle files of %s/%s: %v", videoID, lang, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"subtitles": job.Subtitles})
+}
+
+// EXT-X-MEDIA entries of the caption tracks, served through the signed playlist endpoint
+func subtitleRenditions(videoID string, tracks []jobs.TextTrack, urls signature.URLs) []signature.MediaRendition {
+	renditions := make([]signature.MediaRendition, 0, len(tracks))
+	for _, t := range tracks {
+		renditions = append(renditions, signature.MediaRendition{
+			Type:     "SUBTITLES",
+			GroupID:  "subs",
+			Name:     t.Name,
+			Language: t.Language,
+			Default:  t.Default,
+			URI:      urls.API(fmt.Sprintf("/playlist/%s/%s", videoID, subtitles.Dir(t.Language))),
+		})
+	}
+	return renditions
+}
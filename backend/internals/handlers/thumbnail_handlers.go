@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// still images written by the worker into <version>/thumbs/
+var thumbnailFiles = map[string]string{
+	"poster": "poster.jpg",
+	"thumb":  "thumb.jpg",
+}
+
+// handler to get a signed url of the poster (?kind=poster, the default)
+// or the small thumbnail (?kind=thumb) of a video. With ?redirect=true it
+// redirects to the image, so the endpoint can be used as an <img> src.
+func (h *StreamHandler) Get_thumbnail(c *gin.Context) {
+	videoID := c.Param("video_id")
+	ctx := c.Request.Context()
+
+	kind := c.DefaultQuery("kind", "poster")
+	file, ok := thumbnailFiles[kind]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown thumbnail kind %q", kind)})
+		return
+	}
+
+	thumbPath := path.Join(h.liveVersionDir(ctx, videoID), "thumbs", file)
+	key := path.Join("videos", videoID, thumbPath)
+	// the poster is best effort, a transcode may have gone live without it
+	found, err := h.S3.Exists(ctx, h.streaming_bucket, key)
+	if err != nil {
+		log.Printf("Failed to look up thumbnail %s: %v", key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up thumbnail"})
+		return
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Thumbnail not found"})
+		return
+	}
+
+	// served by nginx from the streaming bucket, signed like the segments
+	expires := time.Now().Add(time.Duration(h.TTL) * time.Second)
+	url := h.urlsFor(c).SignSegment(videoID, thumbPath, expires.Unix(), h.uri_secret)
+
+	if c.Query("redirect") == "true" {
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url":        url,
+		"expires_at": expires.UTC(),
+	})
+}
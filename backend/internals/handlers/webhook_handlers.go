@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/auth"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/webhooks"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handler to register the completion webhook of the calling API key.
+// The returned secret signs every callback and is only shown here.
+func (h *StreamHandler) Register_webhook(c *gin.Context) {
+	clientID := auth.ClientID(c)
+	if clientID == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Webhooks need an %s header", auth.APIKeyHeader)})
+		return
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	reg, err := h.webhooks.Register(c.Request.Context(), clientID, body.URL)
+	var urlErr *webhooks.InvalidURLError
+	if errors.As(err, &urlErr) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid url: %v", urlErr.Err)})
+		return
+	}
+	if errors.Is(err, webhooks.ErrUnknownClient) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This API key may not register webhooks"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to register webhook for %s: %v", clientID, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to register webhook"})
+		return
+	}
+	c.JSON(http.StatusOK, reg)
+}
+
+// handler to show the webhook of the calling API key, without its secret
+func (h *StreamHandler) Get_webhook(c *gin.Context) {
+	clientID := auth.ClientID(c)
+	if clientID == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Webhooks need an %s header", auth.APIKeyHeader)})
+		return
+	}
+
+	reg, err := h.webhooks.Registration(c.Request.Context(), clientID)
+	if errors.Is(err, webhooks.ErrNotRegistered) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No webhook registered"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query webhook"})
+		return
+	}
+	reg.Secret = ""
+	c.JSON(http.StatusOK, reg)
+}
+
+func (h *StreamHandler) Delete_webhook(c *gin.Context) {
+	clientID := auth.ClientID(c)
+	if clientID == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Webhooks need an %s header", auth.APIKeyHeader)})
+		return
+	}
+
+	if err := h.webhooks.Unregister(c.Request.Context(), clientID); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handler to show the webhook delivery attempts of a job, newest first
+func (h *StreamHandler) Webhook_deliveries(c *gin.Context) {
+	jobID := c.Param("id")
+	ctx := c.Request.Context()
+
+	if _, err := h.jobs.Get(ctx, jobID); errors.Is(err, jobs.ErrNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	deliveries, err := h.webhooks.Deliveries(ctx, jobID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to query webhook deliveries"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
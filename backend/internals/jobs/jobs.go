@@ -0,0 +1,212 @@
+package jobs
+
+import (
+	"fmt"
+	"keyflicks_app/internals/probe"
+	"path"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusAwaitingUpload Status = "awaiting_upload"
+	StatusQueued         Status = "queued"
+	StatusProcessing     Status = "processing"
+	StatusReady          Status = "ready"
+	StatusFailed         Status = "failed"
+	StatusCancelled      Status = "cancelled"
+)
+
+// allowed moves between states, a job can always be re-queued once it is finished
+var transitions = map[Status][]Status{
+	StatusAwaitingUpload: {StatusQueued, StatusFailed, StatusCancelled},
+	StatusQueued:         {StatusProcessing, StatusReady, StatusFailed, StatusCancelled},
+	StatusProcessing:     {StatusReady, StatusFailed, StatusCancelled},
+	StatusReady:          {StatusQueued},
+	StatusFailed:         {StatusQueued},
+	StatusCancelled:      {StatusQueued},
+}
+
+// Terminal reports whether the job will not change state on its own anymore
+func (s Status) Terminal() bool {
+	return s == StatusReady || s == StatusFailed || s == StatusCancelled
+}
+
+// Valid reports whether s is one of the known job states
+func (s Status) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Job is the persistent record of a single video transcode
+type Job struct {
+	ID      string      `json:"id"`
+	Status  Status      `json:"status"`
+	S3Key   string      `json:"s3_key,omitempty"`
+	TaskID  string      `json:"task_id,omitempty"`
+	Profile string      `json:"profile,omitempty"`
+	Source  *probe.Info `json:"source,omitempty"`
+	// container, codecs and sizes of the original and the renditions, read from
+	// the MetadataFile of the live version once the job is ready
+	Media     *probe.MediaInfo `json:"media,omitempty"`
+	Uploader  string           `json:"uploader,omitempty"` // client id, see auth.ClientID
+	SizeBytes int64            `json:"size_bytes,omitempty"`
+	Queue     string           `json:"queue,omitempty"`
+	// second of the video the poster frame is taken from, nil for the default
+	PosterAt *float64 `json:"poster_at,omitempty"`
+	// uploaded caption tracks, see subtitles.Dir for where they are stored
+	Subtitles []TextTrack `json:"subtitles,omitempty"`
+	// extra audio languages, packaged into AudioDir(language)
+	AudioTracks []AudioTrack `json:"audio_tracks,omitempty"`
+	// notified once the job is ready or failed, see webhooks.Notifier
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Stage       string     `json:"stage,omitempty"`
+	Percent     float64    `json:"percent"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	QueuedAt    *time.Time `json:"queued_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// times the watchdog re-dispatched the job since it was last queued by a user
+	Retries int `json:"retries,omitempty"`
+
+	// version of the renditions currently served and of the ones being produced,
+	// version 0 lives directly under videos/<id>/, later ones under videos/<id>/v<n>/
+	Version        int        `json:"version"`
+	PendingVersion int        `json:"pending_version"`
+	PublishedAt    *time.Time `json:"published_at,omitempty"`
+}
+
+// TextTrack is a subtitle or caption track of a video
+type TextTrack struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	Default  bool   `json:"default,omitempty"`
+}
+
+// states of an AudioTrack
+const (
+	TrackAwaitingUpload = "awaiting_upload"
+	TrackProcessing     = "processing"
+	TrackReady          = "ready"
+	TrackFailed         = "failed"
+)
+
+// AudioTrack is an extra audio language of a video, e.g. a dub or a commentary
+type AudioTrack struct {
+	Language string `json:"language"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	S3Key    string `json:"s3_key,omitempty"`
+	TaskID   string `json:"task_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// prefix of the folder of an audio track, e.g. videos/<id>/audio_es/
+const audioDirPrefix = "audio_"
+
+// AudioDir is the folder of the audio track of a language relative to videos/<id>/,
+// like subtitles it is shared by all rendition versions
+func AudioDir(language string) string {
+	return audioDirPrefix + language
+}
+
+func IsAudioDir(dir string) bool {
+	return strings.HasPrefix(dir, audioDirPrefix)
+}
+
+// AudioTrack returns the track of a language, nil when there is none
+func (j *Job) AudioTrack(language string) *AudioTrack {
+	for i := range j.AudioTracks {
+		if j.AudioTracks[i].Language == language {
+			return &j.AudioTracks[i]
+		}
+	}
+	return nil
+}
+
+// Live reports whether renditions of the video are served, which stays true
+// while a re-transcode of it is queued, processing, failed or cancelled
+func (j *Job) Live() bool {
+	return j.PublishedAt != nil || j.Version > 0 || j.Status == StatusReady
+}
+
+// file next to master.m3u8 the workers describe the original and the renditions in
+const MetadataFile = "metadata.json"
+
+// OutputPrefix returns the streaming bucket folder of the given rendition version
+func (j *Job) OutputPrefix(version int) string {
+	return path.Join("videos", j.ID, VersionDir(version))
+}
+
+// VersionDir is the folder of a version relative to videos/<id>/
+func VersionDir(version int) string {
+	if version == 0 {
+		return ""
+	}
+	return fmt.Sprintf("v%d", version)
+}
+
+func NewJob(id string, s3Key string, profile string) *Job {
+	now := time.Now().UTC()
+	return &Job{
+		ID:        id,
+		Status:    StatusAwaitingUpload,
+		S3Key:     s3Key,
+		Profile:   profile,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Transition moves the job to the given state and stamps the matching timestamps.
+// Moving to the state the job is already in changes nothing, so a replayed or
+// duplicated event can't restamp a finished job.
+func (j *Job) Transition(to Status, reason string) error {
+	if j.Status == to {
+		return nil
+	}
+
+	allowed := false
+	for _, next := range transitions[j.Status] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("invalid job transition %s -> %s", j.Status, to)
+	}
+
+	now := time.Now().UTC()
+	switch to {
+	case StatusQueued:
+		j.QueuedAt = &now
+		j.StartedAt = nil
+		j.FinishedAt = nil
+		j.Error = ""
+		j.Stage = ""
+		j.Percent = 0
+		j.Retries = 0
+	case StatusProcessing:
+		if j.StartedAt == nil {
+			j.StartedAt = &now
+		}
+	case StatusReady, StatusFailed, StatusCancelled:
+		j.FinishedAt = &now
+		j.Error = reason
+	}
+
+	// switch to the new renditions only once they are complete
+	if to == StatusReady {
+		j.Version = j.PendingVersion
+		j.PublishedAt = &now
+	}
+
+	j.Status = to
+	j.UpdatedAt = now
+	return nil
+}
@@ -0,0 +1,164 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitionMoves(t *testing.T) {
+	all := []Status{StatusAwaitingUpload, StatusQueued, StatusProcessing, StatusReady, StatusFailed, StatusCancelled}
+	allowed := map[Status][]Status{
+		StatusAwaitingUpload: {StatusQueued, StatusFailed, StatusCancelled},
+		StatusQueued:         {StatusProcessing, StatusReady, StatusFailed, StatusCancelled},
+		StatusProcessing:     {StatusReady, StatusFailed, StatusCancelled},
+		StatusReady:          {StatusQueued},
+		StatusFailed:         {StatusQueued},
+		StatusCancelled:      {StatusQueued},
+	}
+
+	for _, from := range all {
+		for _, to := range all {
+			ok := from == to
+			for _, s := range allowed[from] {
+				ok = ok || s == to
+			}
+
+			job := NewJob("vid", "", "")
+			job.Status = from
+			err := job.Transition(to, "")
+			if ok && err != nil {
+				t.Errorf("%s -> %s: unexpected error %v", from, to, err)
+			}
+			if !ok && err == nil {
+				t.Errorf("%s -> %s: expected an error", from, to)
+			}
+			if !ok && job.Status != from {
+				t.Errorf("%s -> %s: refused move changed the status to %s", from, to, job.Status)
+			}
+		}
+	}
+}
+
+func TestTransitionSameState(t *testing.T) {
+	for _, status := range []Status{StatusQueued, StatusProcessing, StatusReady, StatusFailed, StatusCancelled} {
+		job := NewJob("vid", "", "")
+		job.Status = status
+		finished := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		job.FinishedAt = &finished
+		job.UpdatedAt = finished
+		job.Error = "first"
+		job.Percent = 40
+		job.PendingVersion = 2
+
+		if err := job.Transition(status, "second"); err != nil {
+			t.Fatalf("%s -> %s: %v", status, status, err)
+		}
+		if !job.FinishedAt.Equal(finished) || !job.UpdatedAt.Equal(finished) {
+			t.Errorf("%s -> %s restamped the job", status, status)
+		}
+		if job.Error != "first" || job.Percent != 40 || job.Version != 0 {
+			t.Errorf("%s -> %s changed the job: %+v", status, status, job)
+		}
+	}
+}
+
+func TestTransitionTimestamps(t *testing.T) {
+	tests := []struct {
+		from, to  Status
+		reason    string
+		queued    bool
+		started   bool
+		finished  bool
+		published bool
+		wantError string
+	}{
+		{from: StatusAwaitingUpload, to: StatusQueued, queued: true},
+		{from: StatusQueued, to: StatusProcessing, queued: true, started: true},
+		{from: StatusProcessing, to: StatusReady, queued: true, started: true, finished: true, published: true},
+		{from: StatusProcessing, to: StatusFailed, reason: "ffmpeg exited", queued: true, started: true, finished: true, wantError: "ffmpeg exited"},
+		{from: StatusProcessing, to: StatusCancelled, reason: "cancelled by uploader", queued: true, started: true, finished: true, wantError: "cancelled by uploader"},
+		{from: StatusFailed, to: StatusQueued, queued: true},
+	}
+
+	for _, tt := range tests {
+		job := NewJob("vid", "", "")
+		earlier := time.Now().UTC().Add(-time.Hour)
+		job.Status = tt.from
+		job.QueuedAt = &earlier
+		job.StartedAt = &earlier
+		if tt.from.Terminal() {
+			job.FinishedAt = &earlier
+			job.Error = "old"
+			job.Retries = 2
+		}
+		job.PendingVersion = 3
+
+		if err := job.Transition(tt.to, tt.reason); err != nil {
+			t.Fatalf("%s -> %s: %v", tt.from, tt.to, err)
+		}
+		if job.Status != tt.to {
+			t.Errorf("%s -> %s: status is %s", tt.from, tt.to, job.Status)
+		}
+		if (job.QueuedAt != nil) != tt.queued {
+			t.Errorf("%s -> %s: queued_at = %v", tt.from, tt.to, job.QueuedAt)
+		}
+		if (job.StartedAt != nil) != tt.started {
+			t.Errorf("%s -> %s: started_at = %v", tt.from, tt.to, job.StartedAt)
+		}
+		if (job.FinishedAt != nil) != tt.finished {
+			t.Errorf("%s -> %s: finished_at = %v", tt.from, tt.to, job.FinishedAt)
+		}
+		if (job.PublishedAt != nil) != tt.published {
+			t.Errorf("%s -> %s: published_at = %v", tt.from, tt.to, job.PublishedAt)
+		}
+		if job.Error != tt.wantError {
+			t.Errorf("%s -> %s: error = %q, want %q", tt.from, tt.to, job.Error, tt.wantError)
+		}
+		if job.UpdatedAt.Before(earlier.Add(time.Hour - time.Minute)) {
+			t.Errorf("%s -> %s: updated_at was not stamped", tt.from, tt.to)
+		}
+
+		switch tt.to {
+		case StatusQueued:
+			// re-queueing starts a new run
+			if !job.QueuedAt.After(earlier) || job.Retries != 0 {
+				t.Errorf("%s -> %s: run was not reset: %+v", tt.from, tt.to, job)
+			}
+		case StatusProcessing:
+			// a retried worker must not move the start of the run
+			if !job.StartedAt.Equal(earlier) {
+				t.Errorf("%s -> %s: started_at moved", tt.from, tt.to)
+			}
+		case StatusReady:
+			if job.Version != 3 {
+				t.Errorf("%s -> %s: version = %d, want the pending 3", tt.from, tt.to, job.Version)
+			}
+		case StatusFailed, StatusCancelled:
+			if job.Version != 0 {
+				t.Errorf("%s -> %s: version = %d, want the live 0", tt.from, tt.to, job.Version)
+			}
+		}
+	}
+}
+
+func TestLive(t *testing.T) {
+	published := time.Now().UTC()
+	tests := []struct {
+		name string
+		job  Job
+		want bool
+	}{
+		{"first transcode processing", Job{Status: StatusProcessing}, false},
+		{"first transcode failed", Job{Status: StatusFailed}, false},
+		{"ready", Job{Status: StatusReady, PublishedAt: &published}, true},
+		{"ready before published_at existed", Job{Status: StatusReady}, true},
+		{"re-transcode of version 0 queued", Job{Status: StatusQueued, PendingVersion: 1, PublishedAt: &published}, true},
+		{"re-transcode cancelled", Job{Status: StatusCancelled, Version: 1, PendingVersion: 2, PublishedAt: &published}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.job.Live(); got != tt.want {
+			t.Errorf("%s: Live() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/cache"
+	"keyflicks_app/internals/events"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNotFound = errors.New("job not found")
+
+// returned by an update function to leave the record as it is
+var errUnchanged = errors.New("job unchanged")
+
+// Observer is called after a published event was applied to its job
+type Observer func(ctx context.Context, job *Job, ev *events.Event)
+
+// Redis is the part of cache.RedisDB the store keeps the jobs in
+type Redis interface {
+	Set(ctx context.Context, key string, value interface{}, exp_time int) error
+	Get(ctx context.Context, key string) (string, error)
+	Update(ctx context.Context, key string, exp_time int, fn func(current string) (string, error)) error
+	SAdd(ctx context.Context, key string, members ...interface{}) error
+	SRem(ctx context.Context, key string, members ...interface{}) error
+	SMembers(ctx context.Context, key string) ([]string, error)
+}
+
+// Subscriber receives the messages of the channels matching a pattern, see cache.RedisDB
+type Subscriber interface {
+	PSubscribe(ctx context.Context, pattern string) *redis.PubSub
+}
+
+type Store struct {
+	redis     Redis
+	observers []Observer
+}
+
+func NewStore(rds Redis) *Store {
+	return &Store{
+		redis: rds,
+	}
+}
+
+// Observe registers fn for every applied event, it must be called before ListenWorkerStatus
+func (s *Store) Observe(fn Observer) {
+	s.observers = append(s.observers, fn)
+}
+
+func jobKey(id string) string {
+	return fmt.Sprintf("job:%s", id)
+}
+
+// set of the ids of queued and processing jobs, watched by the watchdog
+const activeKey = "jobs:active"
+
+// Create saves a fresh job record, see NewJob
+func (s *Store) Create(ctx context.Context, job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// job records are kept without expiry, they double as the video record
+	return s.redis.Set(ctx, jobKey(job.ID), string(b), 0)
+}
+
+func (s *Store) Get(ctx context.Context, id string) (*Job, error) {
+	data, err := s.redis.Get(ctx, jobKey(id))
+	if errors.Is(err, cache.ErrNil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Update atomically loads the job, applies fn and writes it back.
+// When the job does not exist yet a record is created for it, so that
+// uploads which bypassed Generate_upload_url are still tracked.
+func (s *Store) Update(ctx context.Context, id string, fn func(job *Job) error) (*Job, error) {
+	return s.update(ctx, id, true, fn)
+}
+
+// UpdateExisting is Update for jobs that must exist already, it returns
+// ErrNotFound instead of creating a record for an unknown id
+func (s *Store) UpdateExisting(ctx context.Context, id string, fn func(job *Job) error) (*Job, error) {
+	return s.update(ctx, id, false, fn)
+}
+
+func (s *Store) update(ctx context.Context, id string, create bool, fn func(job *Job) error) (*Job, error) {
+	var updated Job
+
+	err := s.redis.Update(ctx, jobKey(id), 0, func(current string) (string, error) {
+		if current == "" && !create {
+			return "", ErrNotFound
+		}
+		job := NewJob(id, "", "")
+		if current != "" {
+			job = &Job{}
+			if err := json.Unmarshal([]byte(current), job); err != nil {
+				return "", err
+			}
+		}
+
+		if err := fn(job); err != nil {
+			updated = *job
+			return "", err
+		}
+
+		b, err := json.Marshal(job)
+		if err != nil {
+			return "", err
+		}
+		updated = *job
+		return string(b), nil
+	})
+	if errors.Is(err, errUnchanged) {
+		return &updated, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if updated.Status.Terminal() {
+		err = s.redis.SRem(ctx, activeKey, id)
+	} else if updated.Status != StatusAwaitingUpload {
+		err = s.redis.SAdd(ctx, activeKey, id)
+	}
+	if err != nil {
+		log.Printf("jobs: failed to update the active set for job %s: %v", id, err)
+	}
+	return &updated, nil
+}
+
+// Active returns the ids of the queued and processing jobs
+func (s *Store) Active(ctx context.Context) ([]string, error) {
+	return s.redis.SMembers(ctx, activeKey)
+}
+
+// Transition moves a job to the given state, see Job.Transition
+func (s *Store) Transition(ctx context.Context, id string, to Status, reason string) (*Job, error) {
+	return s.Update(ctx, id, func(job *Job) error {
+		return job.Transition(to, reason)
+	})
+}
+
+// Apply updates the job record from a worker event. Every API instance applies
+// every event, and the handlers and the watchdog publish the states they set
+// themselves, so an event repeating the final state of its job leaves it alone.
+// Events of unknown jobs return ErrNotFound instead of creating a record.
+func (s *Store) Apply(ctx context.Context, ev *events.Event) (*Job, error) {
+	if ev.Type == events.TypeTrack {
+		return s.applyTrack(ctx, ev)
+	}
+	return s.UpdateExisting(ctx, ev.JobID, func(job *Job) error {
+		if job.Status.Terminal() && job.Status == Status(ev.Status) {
+			return errUnchanged
+		}
+		reason := ""
+		if ev.Error != nil {
+			reason = ev.Error.Message
+		}
+		if err := job.Transition(Status(ev.Status), reason); err != nil {
+			return err
+		}
+		if ev.Stage != "" {
+			job.Stage = ev.Stage
+		}
+		if ev.Percent != nil {
+			job.Percent = *ev.Percent
+		}
+		if ev.Status == string(StatusReady) {
+			job.Percent = 100
+		}
+		// progress reports are the heartbeat the watchdog looks at
+		job.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// updates the extra track named by a track event
+func (s *Store) applyTrack(ctx context.Context, ev *events.Event) (*Job, error) {
+	return s.UpdateExisting(ctx, ev.JobID, func(job *Job) error {
+		if ev.Track.Kind != "audio" {
+			return fmt.Errorf("unknown track kind %q", ev.Track.Kind)
+		}
+		track := job.AudioTrack(ev.Track.Language)
+		if track == nil {
+			return fmt.Errorf("no %s audio track", ev.Track.Language)
+		}
+		track.State = ev.Track.State
+		track.Error = ""
+		if ev.Error != nil {
+			track.Error = ev.Error.Message
+		}
+		job.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// Handle applies an event to its job and notifies the observers
+func (s *Store) Handle(ctx context.Context, ev *events.Event) {
+	job, err := s.Apply(ctx, ev)
+	if errors.Is(err, ErrNotFound) {
+		// a late event of a deleted job, or one that never existed
+		return
+	}
+	if err != nil {
+		log.Printf("jobs: failed to apply %s event to job %s: %v", ev.Type, ev.JobID, err)
+		return
+	}
+	for _, fn := range s.observers {
+		fn(ctx, job, ev)
+	}
+}
+
+// ListenWorkerStatus keeps the job records in sync with the events published
+// on job_status_<id> and notifies the observers. It blocks until ctx is cancelled.
+func (s *Store) ListenWorkerStatus(ctx context.Context, sub Subscriber) {
+	pubsub := sub.PSubscribe(ctx, events.ChannelPrefix+"*")
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			id := strings.TrimPrefix(msg.Channel, events.ChannelPrefix)
+			ev, err := events.Parse(id, msg.Payload)
+			if err != nil {
+				log.Printf("jobs: ignoring invalid event for job %s: %v", id, err)
+				continue
+			}
+			s.Handle(ctx, ev)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"keyflicks_app/internals/cache/cachetest"
+	"keyflicks_app/internals/events"
+	"testing"
+	"time"
+)
+
+func TestApplyUnknownJob(t *testing.T) {
+	ctx := context.Background()
+	rds := cachetest.NewMemory()
+	store := NewStore(rds)
+	called := false
+	store.Observe(func(ctx context.Context, job *Job, ev *events.Event) { called = true })
+
+	ev := events.NewStatusEvent("gone", string(StatusReady), "")
+	if _, err := store.Apply(ctx, ev); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Apply: got %v, want ErrNotFound", err)
+	}
+	store.Handle(ctx, ev)
+	if called {
+		t.Error("observers were called for an unknown job")
+	}
+	if _, err := store.Get(ctx, "gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Apply created a record for an unknown job: %v", err)
+	}
+}
+
+func TestApplyDuplicateTerminalEvent(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore(cachetest.NewMemory())
+	job := NewJob("vid", "uploads/vid.mp4", "")
+	job.Status = StatusProcessing
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []Status
+	store.Observe(func(ctx context.Context, job *Job, ev *events.Event) { seen = append(seen, job.Status) })
+
+	ev := events.NewStatusEvent("vid", string(StatusFailed), "ffmpeg exited")
+	store.Handle(ctx, ev)
+	first, err := store.Get(ctx, "vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	store.Handle(ctx, events.NewStatusEvent("vid", string(StatusFailed), "again"))
+	second, err := store.Get(ctx, "vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.FinishedAt.Equal(*first.FinishedAt) || !second.UpdatedAt.Equal(first.UpdatedAt) || second.Error != "ffmpeg exited" {
+		t.Errorf("duplicate event changed the job: %+v -> %+v", first, second)
+	}
+	// the observers still see the duplicate, the handlers publish the states they set themselves
+	if len(seen) != 2 || seen[0] != StatusFailed || seen[1] != StatusFailed {
+		t.Errorf("observers saw %v", seen)
+	}
+}
+
+func TestApplyProgressRefreshesHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore(cachetest.NewMemory())
+	job := NewJob("vid", "uploads/vid.mp4", "")
+	job.Status = StatusProcessing
+	job.UpdatedAt = time.Now().UTC().Add(-time.Hour)
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	percent := 42.0
+	ev := &events.Event{Type: events.TypeProgress, JobID: "vid", Status: string(StatusProcessing), Stage: "transcoding", Percent: &percent}
+	updated, err := store.Apply(ctx, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Percent != 42 || updated.Stage != "transcoding" {
+		t.Errorf("progress not applied: %+v", updated)
+	}
+	if time.Since(updated.UpdatedAt) > time.Minute {
+		t.Errorf("updated_at was not refreshed: %v", updated.UpdatedAt)
+	}
+}
@@ -0,0 +1,135 @@
+package keys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/cache"
+)
+
+var ErrNoKey = errors.New("no content key")
+
+// size of an AES-128 content key
+const keySize = 16
+
+// Store keeps the AES-128 content keys of the videos, one per rendition version.
+// Keys are sealed with AES-GCM under a key derived from the secret before they
+// go to Redis, and the same secret signs the key delivery tokens.
+type Store struct {
+	redis    *cache.RedisDB
+	sealKey  []byte
+	tokenKey []byte
+}
+
+func NewStore(rds *cache.RedisDB, secret string) *Store {
+	seal := sha256.Sum256([]byte("content-key-seal:" + secret))
+	token := sha256.Sum256([]byte("content-key-token:" + secret))
+	return &Store{
+		redis:    rds,
+		sealKey:  seal[:],
+		tokenKey: token[:],
+	}
+}
+
+func redisKey(videoID string, version int) string {
+	return fmt.Sprintf("content_key:%s:%d", videoID, version)
+}
+
+// Ensure returns the key of a version, generating it on first use.
+// A retried transcode gets the same key as the attempt before it.
+func (s *Store) Ensure(ctx context.Context, videoID string, version int) ([]byte, error) {
+	key, err := s.Get(ctx, videoID, version)
+	if !errors.Is(err, ErrNoKey) {
+		return key, err
+	}
+
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := s.redis.SetNX(ctx, redisKey(videoID, version), sealed, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		// someone else generated it in the meantime
+		return s.Get(ctx, videoID, version)
+	}
+	return key, nil
+}
+
+// Get returns the key of a version, ErrNoKey when the version is not encrypted
+func (s *Store) Get(ctx context.Context, videoID string, version int) ([]byte, error) {
+	sealed, err := s.redis.Get(ctx, redisKey(videoID, version))
+	if errors.Is(err, cache.ErrNil) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.open(sealed)
+}
+
+// Delete drops the key of a version, its segments can't be played afterwards
+func (s *Store) Delete(ctx context.Context, videoID string, version int) error {
+	return s.redis.Del(ctx, redisKey(videoID, version))
+}
+
+func (s *Store) seal(key []byte) (string, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key, nil)), nil
+}
+
+func (s *Store) open(sealed string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("sealed content key is too short")
+	}
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+}
+
+func (s *Store) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.sealKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Token authorizes fetching the key of a version until expires (unix seconds)
+func (s *Store) Token(videoID string, version int, expires int64) string {
+	mac := hmac.New(sha256.New, s.tokenKey)
+	fmt.Fprintf(mac, "%s:%d:%d", videoID, version, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a token handed out by Token, it does not look at the expiry
+func (s *Store) Verify(videoID string, version int, expires int64, token string) bool {
+	return hmac.Equal([]byte(s.Token(videoID, version, expires)), []byte(token))
+}
@@ -0,0 +1,90 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	store := NewStore(nil, "secret")
+	key := []byte("0123456789abcdef")
+
+	sealed, err := store.seal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.seal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == again {
+		t.Error("sealing twice reused the nonce")
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		store   *Store
+		sealed  string
+		wantErr bool
+	}{
+		{"round trip", store, sealed, false},
+		{"second seal", store, again, false},
+		{"other secret", NewStore(nil, "other"), sealed, true},
+		{"tampered", store, base64.StdEncoding.EncodeToString(flipped), true},
+		{"too short", store, base64.StdEncoding.EncodeToString(raw[:4]), true},
+		{"not base64", store, "not base64!", true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.store.open(tt.sealed)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("%s: opened %x, want %x", tt.name, got, key)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	store := NewStore(nil, "secret")
+	token := store.Token("vid", 2, 1000)
+	tampered := []byte(token)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name    string
+		store   *Store
+		videoID string
+		version int
+		expires int64
+		token   string
+		want    bool
+	}{
+		{"valid", store, "vid", 2, 1000, token, true},
+		{"other video", store, "vid2", 2, 1000, token, false},
+		{"other version", store, "vid", 1, 1000, token, false},
+		{"extended expiry", store, "vid", 2, 2000, token, false},
+		{"other secret", NewStore(nil, "other"), "vid", 2, 1000, token, false},
+		{"tampered", store, "vid", 2, 1000, string(tampered), false},
+		{"empty", store, "vid", 2, 1000, "", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.store.Verify(tt.videoID, tt.version, tt.expires, tt.token); got != tt.want {
+			t.Errorf("%s: Verify() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
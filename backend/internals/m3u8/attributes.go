@@ -0,0 +1,77 @@
+package m3u8
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attribute is one NAME=VALUE pair of an attribute list.
+// Quoted values are stored without their quotes.
+type Attribute struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+func parseAttributes(s string) ([]Attribute, error) {
+	attrs := []Attribute{}
+	for len(s) > 0 {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("m3u8: malformed attribute list %q", s)
+		}
+		attr := Attribute{Name: strings.TrimSpace(name)}
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("m3u8: unterminated quoted string in %q", s)
+			}
+			attr.Value, attr.Quoted = rest[1:end+1], true
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			attr.Value, rest = rest[:end], rest[end:]
+		}
+
+		attrs = append(attrs, attr)
+		s = strings.TrimPrefix(rest, ",")
+	}
+	return attrs, nil
+}
+
+func formatAttributes(attrs []Attribute) string {
+	parts := make([]string, 0, len(attrs))
+	for _, a := range attrs {
+		if a.Quoted {
+			parts = append(parts, fmt.Sprintf(`%s="%s"`, a.Name, a.Value))
+		} else {
+			parts = append(parts, a.Name+"="+a.Value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Attr returns the value of an attribute, "" when the tag does not have it
+func (t *Tag) Attr(name string) string {
+	for _, a := range t.Attrs {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// SetAttr replaces the value of an attribute or appends it
+func (t *Tag) SetAttr(name string, value string, quoted bool) {
+	for i := range t.Attrs {
+		if t.Attrs[i].Name == name {
+			t.Attrs[i].Value, t.Attrs[i].Quoted = value, quoted
+			return
+		}
+	}
+	t.Attrs = append(t.Attrs, Attribute{Name: name, Value: value, Quoted: quoted})
+}
@@ -0,0 +1,312 @@
+// Package m3u8 parses HLS master and media playlists into a list of tags and
+// URI lines and writes them back. Tags it does not know are kept as they are,
+// so a parsed playlist round-trips, and RewriteURIs reaches every URI of it.
+package m3u8
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrNotPlaylist = errors.New("m3u8: missing #EXTM3U header")
+
+// names of the tags the handlers look at
+const (
+	TagHeader          = "EXTM3U"
+	TagInf             = "EXTINF"
+	TagByteRange       = "EXT-X-BYTERANGE"
+	TagKey             = "EXT-X-KEY"
+	TagMap             = "EXT-X-MAP"
+	TagMedia           = "EXT-X-MEDIA"
+	TagStreamInf       = "EXT-X-STREAM-INF"
+	TagIFrameStreamInf = "EXT-X-I-FRAME-STREAM-INF"
+	TagSessionKey      = "EXT-X-SESSION-KEY"
+	TagEndList         = "EXT-X-ENDLIST"
+)
+
+// tags whose value is an attribute list, e.g. METHOD=AES-128,URI="key.bin"
+var attributeTags = map[string]bool{
+	TagKey:                   true,
+	TagMap:                   true,
+	TagMedia:                 true,
+	TagStreamInf:             true,
+	TagIFrameStreamInf:       true,
+	TagSessionKey:            true,
+	"EXT-X-SESSION-DATA":     true,
+	"EXT-X-DATERANGE":        true,
+	"EXT-X-START":            true,
+	"EXT-X-DEFINE":           true,
+	"EXT-X-PART":             true,
+	"EXT-X-PART-INF":         true,
+	"EXT-X-PRELOAD-HINT":     true,
+	"EXT-X-RENDITION-REPORT": true,
+	"EXT-X-SERVER-CONTROL":   true,
+	"EXT-X-SKIP":             true,
+	"EXT-X-CONTENT-STEERING": true,
+}
+
+// Tag is one #EXT line. Attribute list tags are parsed into Attrs,
+// every other tag keeps the text after the colon in Value.
+type Tag struct {
+	Name  string // without the leading '#', e.g. "EXT-X-KEY"
+	Value string
+	Attrs []Attribute
+}
+
+// Item is one line of a playlist: a tag, a URI or a comment
+type Item struct {
+	Tag     *Tag
+	URI     string
+	Comment string // including the leading '#'
+}
+
+// Playlist is a parsed master or media playlist, Items keeps every
+// non-blank line in its original order
+type Playlist struct {
+	Items []*Item
+}
+
+// Parse reads a playlist, the first line has to be #EXTM3U.
+// Blank lines carry no meaning in HLS and are dropped.
+func Parse(content string) (*Playlist, error) {
+	content = strings.TrimPrefix(content, "\ufeff")
+	p := &Playlist{}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(p.Items) == 0 && line != "#"+TagHeader {
+			return nil, ErrNotPlaylist
+		}
+
+		switch {
+		case strings.HasPrefix(line, "#EXT"):
+			tag, err := parseTag(line[1:])
+			if err != nil {
+				return nil, err
+			}
+			p.Items = append(p.Items, &Item{Tag: tag})
+		case strings.HasPrefix(line, "#"):
+			p.Items = append(p.Items, &Item{Comment: line})
+		default:
+			p.Items = append(p.Items, &Item{URI: line})
+		}
+	}
+
+	if len(p.Items) == 0 {
+		return nil, ErrNotPlaylist
+	}
+	return p, nil
+}
+
+func parseTag(line string) (*Tag, error) {
+	name, value, _ := strings.Cut(line, ":")
+	tag := &Tag{Name: name}
+	if !attributeTags[name] {
+		tag.Value = value
+		return tag, nil
+	}
+	attrs, err := parseAttributes(value)
+	if err != nil {
+		return nil, err
+	}
+	tag.Attrs = attrs
+	return tag, nil
+}
+
+// String writes the tag back as a single line
+func (t *Tag) String() string {
+	if t.Attrs != nil {
+		return "#" + t.Name + ":" + formatAttributes(t.Attrs)
+	}
+	if t.Value == "" {
+		return "#" + t.Name
+	}
+	return "#" + t.Name + ":" + t.Value
+}
+
+func (it *Item) String() string {
+	switch {
+	case it.Tag != nil:
+		return it.Tag.String()
+	case it.Comment != "":
+		return it.Comment
+	default:
+		return it.URI
+	}
+}
+
+// String writes the playlist, one item per line with a trailing newline
+func (p *Playlist) String() string {
+	var b strings.Builder
+	for _, it := range p.Items {
+		b.WriteString(it.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Tags returns every tag with the given name in playlist order
+func (p *Playlist) Tags(name string) []*Tag {
+	var tags []*Tag
+	for _, it := range p.Items {
+		if it.Tag != nil && it.Tag.Name == name {
+			tags = append(tags, it.Tag)
+		}
+	}
+	return tags
+}
+
+// IsMaster reports whether the playlist lists variant streams instead of segments
+func (p *Playlist) IsMaster() bool {
+	for _, it := range p.Items {
+		if it.Tag != nil && (it.Tag.Name == TagStreamInf || it.Tag.Name == TagIFrameStreamInf) {
+			return true
+		}
+	}
+	return false
+}
+
+// InsertBeforeVariants adds tags right before the first variant stream of a
+// master playlist, or at the end when there is none
+func (p *Playlist) InsertBeforeVariants(tags ...*Tag) {
+	at := len(p.Items)
+	for i, it := range p.Items {
+		if it.Tag != nil && it.Tag.Name == TagStreamInf {
+			at = i
+			break
+		}
+	}
+
+	items := make([]*Item, 0, len(p.Items)+len(tags))
+	items = append(items, p.Items[:at]...)
+	for _, t := range tags {
+		items = append(items, &Item{Tag: t})
+	}
+	p.Items = append(items, p.Items[at:]...)
+}
+
+// Variant is a variant stream of a master playlist
+type Variant struct {
+	Inf        *Tag // the EXT-X-STREAM-INF tag
+	URI        string
+	Bandwidth  int64
+	Resolution string
+	Codecs     string
+}
+
+// Variants returns the variant streams of a master playlist
+func (p *Playlist) Variants() []Variant {
+	var out []Variant
+	var inf *Tag
+	for _, it := range p.Items {
+		switch {
+		case it.Tag != nil && it.Tag.Name == TagStreamInf:
+			inf = it.Tag
+		case it.Tag == nil && it.Comment == "" && inf != nil:
+			out = append(out, variantOf(inf, it.URI))
+			inf = nil
+		}
+	}
+	return out
+}
+
+// Height is the vertical size of the RESOLUTION attribute, 0 when missing
+func (v Variant) Height() int {
+	_, h, ok := strings.Cut(v.Resolution, "x")
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(h)
+	return n
+}
+
+// FilterVariants drops the variant streams, and the I-frame streams, keep returns false for.
+// The Variant of an EXT-X-I-FRAME-STREAM-INF tag carries the tag as Inf and its URI attribute.
+func (p *Playlist) FilterVariants(keep func(Variant) bool) {
+	items := make([]*Item, 0, len(p.Items))
+	// an EXT-X-STREAM-INF tag and the lines up to its URI, held back until the URI decides
+	var held []*Item
+	for _, it := range p.Items {
+		switch {
+		case it.Tag != nil && it.Tag.Name == TagIFrameStreamInf:
+			if !keep(variantOf(it.Tag, it.Tag.Attr("URI"))) {
+				continue
+			}
+		case it.Tag != nil && it.Tag.Name == TagStreamInf:
+			items = append(items, held...)
+			held = []*Item{it}
+			continue
+		case held != nil && it.Tag == nil && it.Comment == "":
+			if keep(variantOf(held[0].Tag, it.URI)) {
+				items = append(items, held...)
+				items = append(items, it)
+			} else {
+				// comments in between stay
+				items = append(items, held[1:]...)
+			}
+			held = nil
+			continue
+		case held != nil:
+			held = append(held, it)
+			continue
+		}
+		items = append(items, it)
+	}
+	p.Items = append(items, held...)
+}
+
+func variantOf(inf *Tag, uri string) Variant {
+	v := Variant{Inf: inf, URI: uri}
+	v.Bandwidth, _ = strconv.ParseInt(inf.Attr("BANDWIDTH"), 10, 64)
+	v.Resolution = inf.Attr("RESOLUTION")
+	v.Codecs = inf.Attr("CODECS")
+	return v
+}
+
+// Segment is a media segment together with the tags in effect for it
+type Segment struct {
+	URI       string
+	Duration  float64 // seconds
+	Title     string
+	ByteRange string // "<length>[@<offset>]", empty for whole files
+	Key       *Tag   // EXT-X-KEY in effect, nil when unencrypted
+	Map       *Tag   // EXT-X-MAP in effect, nil for transport streams
+}
+
+// Segments returns the media segments of a media playlist
+func (p *Playlist) Segments() []Segment {
+	var out []Segment
+	var cur Segment
+	var key, init *Tag
+	for _, it := range p.Items {
+		if it.Tag != nil {
+			switch it.Tag.Name {
+			case TagInf:
+				d, title, _ := strings.Cut(it.Tag.Value, ",")
+				cur.Duration, _ = strconv.ParseFloat(d, 64)
+				cur.Title = title
+			case TagByteRange:
+				cur.ByteRange = it.Tag.Value
+			case TagKey:
+				key = it.Tag
+				if it.Tag.Attr("METHOD") == "NONE" {
+					key = nil
+				}
+			case TagMap:
+				init = it.Tag
+			}
+			continue
+		}
+		if it.Comment != "" {
+			continue
+		}
+		cur.URI, cur.Key, cur.Map = it.URI, key, init
+		out = append(out, cur)
+		cur = Segment{}
+	}
+	return out
+}
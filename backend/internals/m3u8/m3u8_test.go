@@ -0,0 +1,310 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+)
+
+func lines(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string // "" when the playlist is written back unchanged
+	}{
+		{
+			name: "unknown tags and comments",
+			in: lines(
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				"# generated by the worker",
+				"#EXT-X-CUSTOM-THING:foo=bar,baz",
+				"#EXT-X-INDEPENDENT-SEGMENTS",
+				"#EXTINF:6.000,title, with comma",
+				"seg_000.ts",
+				"#EXT-X-ENDLIST",
+			),
+		},
+		{
+			name: "quoted values with commas",
+			in: lines(
+				"#EXTM3U",
+				`#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=640x360`,
+				"360p/playlist.m3u8",
+			),
+		},
+		{
+			name: "byte order mark, CRLF and blank lines",
+			in:   "\ufeff#EXTM3U\r\n\r\n#EXTINF:4.0,\r\nseg.ts\r\n",
+			out:  lines("#EXTM3U", "#EXTINF:4.0,", "seg.ts"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.out
+			if want == "" {
+				want = tt.in
+			}
+			if got := p.String(); got != want {
+				t.Errorf("round trip\n got: %q\nwant: %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	p, err := Parse(lines(
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="Director, commentary",DEFAULT=NO,URI="a/b.m3u8"`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := p.Tags(TagMedia)[0]
+	for name, want := range map[string]string{
+		"TYPE":     "AUDIO",
+		"GROUP-ID": "aud",
+		"NAME":     "Director, commentary",
+		"DEFAULT":  "NO",
+		"URI":      "a/b.m3u8",
+	} {
+		if got := tag.Attr(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"missing header", lines("#EXTINF:6,", "seg.ts")},
+		{"header not first", lines("seg.ts", "#EXTM3U")},
+		{"unterminated quoted string", lines("#EXTM3U", `#EXT-X-KEY:METHOD=AES-128,URI="key.bin`)},
+		{"attribute without value", lines("#EXTM3U", "#EXT-X-STREAM-INF:BANDWIDTH=1,RESOLUTION", "a.m3u8")},
+		{"junk after quoted string", lines("#EXTM3U", `#EXT-X-MAP:URI="init.mp4"junk`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.in); err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", tt.in)
+			}
+		})
+	}
+}
+
+func TestFilterVariants(t *testing.T) {
+	master := lines(
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio_en/playlist.m3u8"`,
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360",
+		"360p/playlist.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720",
+		"# the hd one",
+		"720p/playlist.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080",
+		"1080p/playlist.m3u8",
+		`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=640x360,URI="360p/iframes.m3u8"`,
+		`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=300000,RESOLUTION=1920x1080,URI="1080p/iframes.m3u8"`,
+	)
+
+	tests := []struct {
+		name      string
+		maxHeight int
+		want      string
+	}{
+		{
+			name:      "keeps everything",
+			maxHeight: 1080,
+			want:      master,
+		},
+		{
+			name:      "drops the tag together with its uri",
+			maxHeight: 720,
+			want: lines(
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio_en/playlist.m3u8"`,
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360",
+				"360p/playlist.m3u8",
+				"#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720",
+				"# the hd one",
+				"720p/playlist.m3u8",
+				`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=640x360,URI="360p/iframes.m3u8"`,
+			),
+		},
+		{
+			name:      "keeps the comment of a dropped variant",
+			maxHeight: 360,
+			want: lines(
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio_en/playlist.m3u8"`,
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360",
+				"360p/playlist.m3u8",
+				"# the hd one",
+				`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=640x360,URI="360p/iframes.m3u8"`,
+			),
+		},
+		{
+			name:      "drops everything",
+			maxHeight: 240,
+			want: lines(
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="audio_en/playlist.m3u8"`,
+				"# the hd one",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(master)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.FilterVariants(func(v Variant) bool { return v.Height() <= tt.maxHeight })
+			if got := p.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariants(t *testing.T) {
+	p, err := Parse(lines(
+		"#EXTM3U",
+		`#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=640x360`,
+		"360p/playlist.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=64000",
+		"audio.m3u8",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := p.Variants()
+	if len(v) != 2 {
+		t.Fatalf("got %d variants, want 2", len(v))
+	}
+	if v[0].URI != "360p/playlist.m3u8" || v[0].Bandwidth != 800000 || v[0].Height() != 360 || v[0].Codecs != "avc1.64001f,mp4a.40.2" {
+		t.Errorf("unexpected first variant %+v", v[0])
+	}
+	if v[1].Height() != 0 || v[1].Bandwidth != 64000 {
+		t.Errorf("unexpected second variant %+v", v[1])
+	}
+}
+
+func TestSegments(t *testing.T) {
+	p, err := Parse(lines(
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/api/keys/abc?v=1"`,
+		"#EXTINF:6.006,first",
+		"#EXT-X-BYTERANGE:1000@720",
+		"stream.mp4",
+		"# a comment between segments",
+		"#EXTINF:6.006,",
+		"#EXT-X-BYTERANGE:2000",
+		"stream.mp4",
+		"#EXT-X-KEY:METHOD=NONE",
+		"#EXTINF:4.5,",
+		"tail.m4s",
+		`#EXT-X-MAP:URI="init2.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="k2"`,
+		"#EXTINF:2,",
+		"last.m4s",
+		"#EXT-X-ENDLIST",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri       string
+		duration  float64
+		title     string
+		byteRange string
+		key       string // URI of the key in effect
+		init      string // URI of the map in effect
+	}{
+		{"stream.mp4", 6.006, "first", "1000@720", "/api/keys/abc?v=1", "init.mp4"},
+		{"stream.mp4", 6.006, "", "2000", "/api/keys/abc?v=1", "init.mp4"},
+		{"tail.m4s", 4.5, "", "", "", "init.mp4"},
+		{"last.m4s", 2, "", "", "k2", "init2.mp4"},
+	}
+
+	segments := p.Segments()
+	if len(segments) != len(tests) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(tests))
+	}
+	for i, tt := range tests {
+		s := segments[i]
+		key, init := "", ""
+		if s.Key != nil {
+			key = s.Key.Attr("URI")
+		}
+		if s.Map != nil {
+			init = s.Map.Attr("URI")
+		}
+		if s.URI != tt.uri || s.Duration != tt.duration || s.Title != tt.title || s.ByteRange != tt.byteRange || key != tt.key || init != tt.init {
+			t.Errorf("segment %d = {%s %v %q %q key=%q map=%q}, want %+v", i, s.URI, s.Duration, s.Title, s.ByteRange, key, init, tt)
+		}
+	}
+}
+
+func TestRewriteURIs(t *testing.T) {
+	p, err := Parse(lines(
+		"#EXTM3U",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="key"`,
+		"# comment.ts",
+		"#EXTINF:6,",
+		"seg.m4s",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	err = p.RewriteURIs(func(ref URIRef) (string, error) {
+		kind := "line"
+		if !ref.Line() {
+			kind = ref.Tag.Name
+		}
+		seen = append(seen, kind+":"+ref.URI)
+		return "/x/" + ref.URI, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"EXT-X-MAP:init.mp4", "EXT-X-KEY:key", "line:seg.m4s"}
+	if strings.Join(seen, " ") != strings.Join(want, " ") {
+		t.Errorf("visited %v, want %v", seen, want)
+	}
+	wantOut := lines(
+		"#EXTM3U",
+		`#EXT-X-MAP:URI="/x/init.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="/x/key"`,
+		"# comment.ts",
+		"#EXTINF:6,",
+		"/x/seg.m4s",
+	)
+	if got := p.String(); got != wantOut {
+		t.Errorf("got\n%s\nwant\n%s", got, wantOut)
+	}
+}
@@ -0,0 +1,43 @@
+package m3u8
+
+// URIRef tells a URI visitor where a URI was found
+type URIRef struct {
+	// tag carrying the URI attribute (EXT-X-KEY, EXT-X-MAP, EXT-X-MEDIA..),
+	// nil for the URI lines of segments and variant streams
+	Tag *Tag
+	URI string
+}
+
+// Line reports whether the URI is a segment or variant stream line
+func (r URIRef) Line() bool {
+	return r.Tag == nil
+}
+
+// RewriteURIs calls fn for every URI of the playlist, the URI lines as well as
+// the URI attributes of tags, and replaces it with what fn returns.
+// An error from fn stops the rewrite and is returned.
+func (p *Playlist) RewriteURIs(fn func(ref URIRef) (string, error)) error {
+	for _, it := range p.Items {
+		switch {
+		case it.Tag != nil:
+			for i := range it.Tag.Attrs {
+				a := &it.Tag.Attrs[i]
+				if a.Name != "URI" || a.Value == "" {
+					continue
+				}
+				uri, err := fn(URIRef{Tag: it.Tag, URI: a.Value})
+				if err != nil {
+					return err
+				}
+				a.Value = uri
+			}
+		case it.Comment == "":
+			uri, err := fn(URIRef{URI: it.URI})
+			if err != nil {
+				return err
+			}
+			it.URI = uri
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package probe
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Metadata is the technical description of the original upload or of one rendition,
+// the python worker writes the same layout into metadata.json
+type Metadata struct {
+	Container string       `json:"container"`
+	Duration  float64      `json:"duration"` // seconds
+	SizeBytes int64        `json:"size_bytes"`
+	Bitrate   int64        `json:"bitrate,omitempty"` // bits per second
+	Video     *VideoStream `json:"video,omitempty"`
+	Audio     *AudioStream `json:"audio,omitempty"`
+}
+
+type VideoStream struct {
+	Codec     string  `json:"codec"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	FrameRate float64 `json:"frame_rate"`
+}
+
+type AudioStream struct {
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels"`
+	SampleRate int    `json:"sample_rate"`
+}
+
+// MediaInfo is the metadata of a whole transcode, renditions are keyed by name (e.g. "720p")
+type MediaInfo struct {
+	Original   *Metadata            `json:"original,omitempty"`
+	Renditions map[string]*Metadata `json:"renditions,omitempty"`
+	// extras the transcode could not make, e.g. "thumbnails" or "sprites", with the reason
+	Warnings map[string]string `json:"warnings,omitempty"`
+}
+
+// Extract probes url for its container and first video and audio stream.
+// Size and bitrate are left zero when ffprobe can't tell, e.g. for HLS playlists.
+func Extract(ctx context.Context, url string) (*Metadata, error) {
+	parsed, err := ffprobe(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{
+		// ffprobe lists every name of the demuxer, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+		Container: strings.Split(parsed.Format.FormatName, ",")[0],
+	}
+	md.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	md.SizeBytes, _ = strconv.ParseInt(parsed.Format.Size, 10, 64)
+	md.Bitrate, _ = strconv.ParseInt(parsed.Format.BitRate, 10, 64)
+
+	for i := range parsed.Streams {
+		s := &parsed.Streams[i]
+		switch {
+		case s.CodecType == "video" && md.Video == nil:
+			width, height := s.displaySize()
+			rate := frameRate(s.AvgFrameRate)
+			if rate == 0 {
+				rate = frameRate(s.RFrameRate)
+			}
+			md.Video = &VideoStream{Codec: s.CodecName, Width: width, Height: height, FrameRate: rate}
+		case s.CodecType == "audio" && md.Audio == nil:
+			sampleRate, _ := strconv.Atoi(s.SampleRate)
+			md.Audio = &AudioStream{Codec: s.CodecName, Channels: s.Channels, SampleRate: sampleRate}
+		}
+	}
+	return md, nil
+}
+
+// frameRate parses ffprobe's rational rates like "30000/1001", rounded to 3 decimals
+func frameRate(rational string) float64 {
+	num, den, ok := strings.Cut(rational, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return float64(int64(n/d*1000+0.5)) / 1000
+}
@@ -0,0 +1,113 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Info describes the video stream of a media file
+type Info struct {
+	// displayed dimensions, already corrected for rotation metadata
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Duration float64 `json:"duration"` // seconds
+}
+
+// ShortSide is the dimension ladders are compared against,
+// so portrait clips are not treated as 1920p
+func (i *Info) ShortSide() int {
+	return min(i.Width, i.Height)
+}
+
+// subset of the ffprobe json output we care about
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	CodecType    string            `json:"codec_type"`
+	CodecName    string            `json:"codec_name"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	AvgFrameRate string            `json:"avg_frame_rate"`
+	RFrameRate   string            `json:"r_frame_rate"`
+	Channels     int               `json:"channels"`
+	SampleRate   string            `json:"sample_rate"`
+	Tags         map[string]string `json:"tags"`
+	SideData     []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// displayed dimensions of a video stream, corrected for rotation metadata
+func (s *ffprobeStream) displaySize() (int, int) {
+	rotation, _ := strconv.ParseFloat(s.Tags["rotate"], 64)
+	for _, sd := range s.SideData {
+		if sd.Rotation != 0 {
+			rotation = sd.Rotation
+		}
+	}
+	if int(rotation)%180 != 0 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// Probe runs ffprobe against url, which may be a presigned GET url.
+// ffprobe only reads the container headers, not the whole file.
+func Probe(ctx context.Context, url string) (*Info, error) {
+	parsed, err := ffprobe(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	info.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+
+	for _, s := range parsed.Streams {
+		if s.CodecType != "video" {
+			continue
+		}
+		info.Width, info.Height = s.displaySize()
+		break
+	}
+
+	if info.Width == 0 || info.Height == 0 {
+		return nil, fmt.Errorf("ffprobe: no video stream found")
+	}
+	return info, nil
+}
+
+func ffprobe(ctx context.Context, url string) (*ffprobeOutput, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		url,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var parsed ffprobeOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return nil, fmt.Errorf("ffprobe: malformed output: %w", err)
+	}
+
+	return &parsed, nil
+}
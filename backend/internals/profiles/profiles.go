@@ -0,0 +1,163 @@
+package profiles
+
+import "sort"
+
+// name of the profile used when an upload does not ask for one
+const Default = "default"
+
+// containers of the HLS segments
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4" // CMAF, needed for AV1 and by Apple players for HEVC
+)
+
+// Rendition is one step of the bitrate ladder
+type Rendition struct {
+	// folder of the rendition in the output, e.g. "720p"
+	Name         string `json:"name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoBitrate int    `json:"video_bitrate"` // bits per second
+	AudioBitrate int    `json:"audio_bitrate"` // bits per second
+}
+
+// Bandwidth is the peak bitrate advertised in the master playlist
+func (r Rendition) Bandwidth() int {
+	return r.VideoBitrate + r.AudioBitrate
+}
+
+// Profile is a named set of encoding settings, sent to the worker with every job
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// video codec, "h264", "hevc" or "av1"
+	Codec string `json:"codec"`
+	// segment container, ContainerTS when empty
+	Container string `json:"container,omitempty"`
+	// one file per rendition, the playlist addresses the segments with byte ranges
+	SingleFile bool `json:"single_file,omitempty"`
+	// target HLS segment length in seconds
+	SegmentDuration int         `json:"segment_duration"`
+	Renditions      []Rendition `json:"renditions"`
+}
+
+// FMP4 reports whether the renditions are fragmented MP4 with an init segment
+func (p Profile) FMP4() bool {
+	return p.Container == ContainerFMP4
+}
+
+// HLSVersion is the EXT-X-VERSION the playlists of the profile need,
+// byte ranges came with version 4 and EXT-X-MAP in VOD playlists with 6
+func (p Profile) HLSVersion() int {
+	switch {
+	case p.FMP4():
+		return 7
+	case p.SingleFile:
+		return 4
+	}
+	return 3
+}
+
+var registry = map[string]Profile{
+	Default: {
+		Name:            Default,
+		Description:     "H.264 ladder from 360p up to 1080p",
+		Codec:           "h264",
+		SegmentDuration: 6,
+		Renditions: []Rendition{
+			{Name: "360p", Width: 640, Height: 360, VideoBitrate: 672000, AudioBitrate: 128000},
+			{Name: "480p", Width: 854, Height: 480, VideoBitrate: 1272000, AudioBitrate: 128000},
+			{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 2672000, AudioBitrate: 128000},
+			{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 4872000, AudioBitrate: 128000},
+		},
+	},
+	"mobile": {
+		Name:            "mobile",
+		Description:     "Small H.264 ladder for phone clips and slow networks",
+		Codec:           "h264",
+		SegmentDuration: 4,
+		Renditions: []Rendition{
+			{Name: "240p", Width: 426, Height: 240, VideoBitrate: 336000, AudioBitrate: 64000},
+			{Name: "360p", Width: 640, Height: 360, VideoBitrate: 672000, AudioBitrate: 96000},
+			{Name: "480p", Width: 854, Height: 480, VideoBitrate: 1272000, AudioBitrate: 96000},
+		},
+	},
+	"hevc-hq": {
+		Name:            "hevc-hq",
+		Description:     "HEVC ladder up to 2160p for high quality sources, in fMP4 segments",
+		Codec:           "hevc",
+		Container:       ContainerFMP4,
+		SegmentDuration: 6,
+		Renditions: []Rendition{
+			{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 1800000, AudioBitrate: 128000},
+			{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 3400000, AudioBitrate: 192000},
+			{Name: "1440p", Width: 2560, Height: 1440, VideoBitrate: 6000000, AudioBitrate: 192000},
+			{Name: "2160p", Width: 3840, Height: 2160, VideoBitrate: 12000000, AudioBitrate: 192000},
+		},
+	},
+	"av1": {
+		Name:            "av1",
+		Description:     "AV1 ladder from 360p up to 1080p in fMP4 segments, for recent browsers and TVs",
+		Codec:           "av1",
+		Container:       ContainerFMP4,
+		SegmentDuration: 6,
+		Renditions: []Rendition{
+			{Name: "360p", Width: 640, Height: 360, VideoBitrate: 400000, AudioBitrate: 96000},
+			{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 1500000, AudioBitrate: 128000},
+			{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 2800000, AudioBitrate: 128000},
+		},
+	},
+	"cmaf": {
+		Name:            "cmaf",
+		Description:     "H.264 ladder as one fMP4 file per rendition, addressed with byte ranges",
+		Codec:           "h264",
+		Container:       ContainerFMP4,
+		SingleFile:      true,
+		SegmentDuration: 6,
+		Renditions: []Rendition{
+			{Name: "360p", Width: 640, Height: 360, VideoBitrate: 672000, AudioBitrate: 128000},
+			{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 2672000, AudioBitrate: 128000},
+			{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 4872000, AudioBitrate: 128000},
+		},
+	},
+}
+
+// Get looks up a profile by name
+func Get(name string) (Profile, bool) {
+	p, ok := registry[name]
+	return p, ok
+}
+
+// List returns all profiles sorted by name
+func List() []Profile {
+	out := make([]Profile, 0, len(registry))
+	for _, p := range registry {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ForSource returns a copy of the profile without the renditions that would
+// upscale a source whose shorter side is sourceHeight pixels.
+// The smallest rendition is always kept so there is something to play.
+func (p Profile) ForSource(sourceHeight int) Profile {
+	out := p
+	out.Renditions = make([]Rendition, 0, len(p.Renditions))
+	for _, r := range p.Renditions {
+		if r.Height <= sourceHeight {
+			out.Renditions = append(out.Renditions, r)
+		}
+	}
+
+	if len(out.Renditions) == 0 && len(p.Renditions) > 0 {
+		smallest := p.Renditions[0]
+		for _, r := range p.Renditions[1:] {
+			if r.Height < smallest.Height {
+				smallest = r
+			}
+		}
+		out.Renditions = append(out.Renditions, smallest)
+	}
+	return out
+}
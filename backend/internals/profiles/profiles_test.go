@@ -0,0 +1,57 @@
+package profiles
+
+import (
+	"reflect"
+	"testing"
+)
+
+func names(renditions []Rendition) []string {
+	out := []string{}
+	for _, r := range renditions {
+		out = append(out, r.Name)
+	}
+	return out
+}
+
+func TestForSource(t *testing.T) {
+	tests := []struct {
+		profile string
+		source  int
+		want    []string
+	}{
+		{Default, 2160, []string{"360p", "480p", "720p", "1080p"}},
+		{Default, 1080, []string{"360p", "480p", "720p", "1080p"}},
+		{Default, 1079, []string{"360p", "480p", "720p"}},
+		{Default, 720, []string{"360p", "480p", "720p"}},
+		{Default, 480, []string{"360p", "480p"}},
+		// smaller than the whole ladder, the smallest rendition is kept
+		{Default, 240, []string{"360p"}},
+		{"mobile", 1080, []string{"240p", "360p", "480p"}},
+		{"hevc-hq", 1080, []string{"720p", "1080p"}},
+		{"hevc-hq", 480, []string{"720p"}},
+	}
+
+	for _, tt := range tests {
+		p, ok := Get(tt.profile)
+		if !ok {
+			t.Fatalf("profile %s missing", tt.profile)
+		}
+		got := p.ForSource(tt.source)
+		if !reflect.DeepEqual(names(got.Renditions), tt.want) {
+			t.Errorf("%s.ForSource(%d) = %v, want %v", tt.profile, tt.source, names(got.Renditions), tt.want)
+		}
+		if got.Name != p.Name || got.Codec != p.Codec || got.SegmentDuration != p.SegmentDuration {
+			t.Errorf("%s.ForSource(%d) changed the settings: %+v", tt.profile, tt.source, got)
+		}
+	}
+}
+
+func TestForSourceKeepsRegistry(t *testing.T) {
+	p, _ := Get(Default)
+	p.ForSource(360)
+
+	again, _ := Get(Default)
+	if len(again.Renditions) != 4 {
+		t.Errorf("ForSource changed the registered profile: %v", names(again.Renditions))
+	}
+}
@@ -14,6 +14,23 @@ func SetupStreamingRoutes(router *gin.Engine, streamHandler *handlers.StreamHand
 		streamRoutes.POST("/s3-webhook", streamHandler.Handle_s3_event)
 		streamRoutes.GET("/playlist/:video_id/:resolution_path", streamHandler.Sign_segments)
 		streamRoutes.GET("/master/:video_id", streamHandler.Modified_master)
+		streamRoutes.GET("/dash/:video_id", streamHandler.Dash_manifest)
 		streamRoutes.GET("/status/:upload_id", streamHandler.Stream_status)
+		streamRoutes.GET("/thumbnail/:video_id", streamHandler.Get_thumbnail)
+		streamRoutes.GET("/sprites/:video_id", streamHandler.Sprite_track)
+		streamRoutes.GET("/keys/:video_id", streamHandler.Get_key)
+		streamRoutes.GET("/jobs/:id", streamHandler.Get_job)
+		streamRoutes.DELETE("/jobs/:id", streamHandler.Cancel_job)
+		streamRoutes.GET("/jobs/:id/webhooks", streamHandler.Webhook_deliveries)
+		streamRoutes.POST("/videos/:id/retranscode", streamHandler.Retranscode_video)
+		streamRoutes.POST("/videos/:id/subtitles", streamHandler.Upload_subtitles)
+		streamRoutes.DELETE("/videos/:id/subtitles/:lang", streamHandler.Delete_subtitles)
+		streamRoutes.POST("/videos/:id/audio", streamHandler.Add_audio_track)
+		streamRoutes.DELETE("/videos/:id/audio/:lang", streamHandler.Delete_audio_track)
+		streamRoutes.GET("/profiles", streamHandler.List_profiles)
+		streamRoutes.GET("/queues", streamHandler.Queue_status)
+		streamRoutes.PUT("/webhooks", streamHandler.Register_webhook)
+		streamRoutes.GET("/webhooks", streamHandler.Get_webhook)
+		streamRoutes.DELETE("/webhooks", streamHandler.Delete_webhook)
 	}
 }
@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/profiles"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// packageAudio turns an extra audio file into an AAC HLS rendition below req.OutputPrefix
+func (r *Runner) packageAudio(ctx context.Context, req dispatch.AudioRequest) (map[string]interface{}, error) {
+	r.publishTrack(req, "processing", nil)
+
+	err := r.produceAudio(ctx, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.publishTrack(req, "failed", err)
+		}
+		return nil, err
+	}
+
+	r.publishTrack(req, "ready", nil)
+	return map[string]interface{}{
+		"status":        "success",
+		"upload_id":     req.UploadID,
+		"language":      req.Language,
+		"output_prefix": req.OutputPrefix,
+	}, nil
+}
+
+func (r *Runner) produceAudio(ctx context.Context, req dispatch.AudioRequest) error {
+	workDir, err := os.MkdirTemp("", "audio-"+req.UploadID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	url, err := r.S3.GeneratePresignedGetUrl(ctx, r.pending_bucket, req.S3Key, time.Hour)
+	if err != nil {
+		return &codedError{code: "S3Error", err: err}
+	}
+
+	segment := req.SegmentDuration
+	if segment <= 0 {
+		segment = 6
+	}
+	bitrate := req.Bitrate
+	if bitrate <= 0 {
+		bitrate = 128000
+	}
+
+	args := []string{
+		"-y", "-v", "error",
+		"-i", url,
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", strconv.Itoa(bitrate),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segment),
+		"-hls_playlist_type", "vod",
+	}
+	// same segment layout as the video renditions, see ffmpegArgs
+	ext := ".ts"
+	if req.Container == profiles.ContainerFMP4 {
+		ext = ".m4s"
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4")
+	}
+	args = append(args,
+		"-hls_segment_filename", filepath.Join(workDir, "seg_%03d"+ext),
+		filepath.Join(workDir, "playlist.m3u8"),
+	)
+	if err := runFFmpeg(ctx, args, 0, func(float64) {}); err != nil {
+		return &codedError{code: "FFmpegError", err: err}
+	}
+
+	if err := r.uploadDir(ctx, workDir, req.OutputPrefix); err != nil {
+		return &codedError{code: "S3Error", err: err}
+	}
+	return nil
+}
+
+func (r *Runner) publishTrack(req dispatch.AudioRequest, state string, err error) {
+	reason := ""
+	if err != nil {
+		reason = fmt.Sprintf("%s: %v", taskError(err).Type, err)
+	}
+	ev := events.NewTrackEvent(req.UploadID, "audio", req.Language, state, reason)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.bus.Publish(ctx, ev); err != nil {
+		log.Printf("Failed to publish %s audio track event for job %s: %v", req.Language, req.UploadID, err)
+	}
+}
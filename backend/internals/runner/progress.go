@@ -0,0 +1,137 @@
+package runner
+
+import (
+	"context"
+	"keyflicks_app/internals/events"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// minimum time between two progress events, same as the python worker
+const progressInterval = time.Second
+
+// reporter publishes the status and progress events of one job,
+// it mirrors JobEvents in worker_application/app/events.py
+type reporter struct {
+	bus   *events.Bus
+	jobID string
+
+	mu           sync.Mutex
+	seq          int64
+	stage        string
+	started      time.Time
+	lastProgress time.Time
+	renditions   map[string]events.RenditionState
+}
+
+func newReporter(bus *events.Bus, jobID string, renditions []string) *reporter {
+	states := make(map[string]events.RenditionState, len(renditions))
+	for _, name := range renditions {
+		states[name] = events.RenditionState{State: "pending"}
+	}
+	return &reporter{
+		bus:        bus,
+		jobID:      jobID,
+		stage:      "queued",
+		started:    time.Now(),
+		renditions: states,
+	}
+}
+
+// publish stamps and sends the event, r.mu must be held
+func (r *reporter) publish(ev *events.Event) {
+	r.seq++
+	ev.Version = events.SchemaVersion
+	ev.Seq = r.seq
+	ev.JobID = r.jobID
+	ev.Timestamp = time.Now().UTC()
+
+	// events are published even after a cancel, so they are sent on their own context
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.bus.Publish(ctx, ev); err != nil {
+		log.Printf("Failed to publish %s event for job %s: %v", ev.Type, r.jobID, err)
+	}
+}
+
+func (r *reporter) status(status string, code string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ev := events.NewStatusEvent(r.jobID, status, reason)
+	if status == "ready" {
+		r.stage = "done"
+		percent := 100.0
+		ev.Percent = &percent
+	}
+	ev.Stage = r.stage
+	if ev.Error != nil {
+		ev.Error.Code = code
+	}
+	r.publish(ev)
+}
+
+func (r *reporter) setStage(stage string) {
+	r.mu.Lock()
+	r.stage = stage
+	r.mu.Unlock()
+	r.progress("", true)
+}
+
+// rendition updates one rendition, an empty state or a negative percent keeps the current value
+func (r *reporter) rendition(name string, state string, percent float64) {
+	r.mu.Lock()
+	rs := r.renditions[name]
+	if state != "" {
+		rs.State = state
+	}
+	if percent >= 0 {
+		rs.Percent = math.Round(math.Min(100, percent)*10) / 10
+	}
+	if state == "done" {
+		rs.Percent = 100
+	}
+	r.renditions[name] = rs
+	r.mu.Unlock()
+
+	r.progress(name, state != "")
+}
+
+func (r *reporter) progress(rendition string, force bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if !force && now.Sub(r.lastProgress) < progressInterval {
+		return
+	}
+	r.lastProgress = now
+
+	var total float64
+	snapshot := make(map[string]events.RenditionState, len(r.renditions))
+	for name, rs := range r.renditions {
+		total += rs.Percent
+		snapshot[name] = rs
+	}
+	percent := 0.0
+	if len(r.renditions) > 0 {
+		percent = math.Round(total/float64(len(r.renditions))*10) / 10
+	}
+
+	ev := &events.Event{
+		Type:       events.TypeProgress,
+		Status:     "processing",
+		Stage:      r.stage,
+		Percent:    &percent,
+		Rendition:  rendition,
+		Renditions: snapshot,
+	}
+	if percent > 0 && percent < 100 {
+		elapsed := now.Sub(r.started).Seconds()
+		eta := math.Round(elapsed*(100-percent)/percent*10) / 10
+		ev.ETASeconds = &eta
+	}
+	r.publish(ev)
+}
@@ -0,0 +1,187 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/s3_store"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// name reported for the in-process queue
+	queueName = "local"
+	// finished tasks are forgotten after this long, like celery's result expiry
+	resultTTL = 24 * time.Hour
+)
+
+var errQueueFull = errors.New("local transcode queue is full")
+
+// Runner transcodes in-process with ffmpeg on the CPU, so local development
+// works without the python workers. Jobs run in a fixed number of workers,
+// the rest wait in a bounded queue.
+type Runner struct {
+	S3               *s3_store.S3Store
+	bus              *events.Bus
+	pending_bucket   string
+	streaming_bucket string
+
+	queue chan *task
+
+	mu    sync.Mutex
+	tasks map[string]*task
+}
+
+type task struct {
+	// video the task works on, for logging
+	jobID   string
+	work    func(ctx context.Context) (map[string]interface{}, error)
+	result  dispatch.TaskResult
+	cancel  context.CancelFunc
+	revoked bool
+}
+
+var _ dispatch.Dispatcher = (*Runner)(nil)
+
+// NewRunner starts workers goroutines, at most backlog jobs can wait for one
+func NewRunner(s3 *s3_store.S3Store, bus *events.Bus, pend_bucket string, stream_bucket string, workers int, backlog int) *Runner {
+	if workers < 1 {
+		workers = 1
+	}
+	r := &Runner{
+		S3:               s3,
+		bus:              bus,
+		pending_bucket:   pend_bucket,
+		streaming_bucket: stream_bucket,
+		queue:            make(chan *task, backlog),
+		tasks:            make(map[string]*task),
+	}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+func (r *Runner) Dispatch(ctx context.Context, req dispatch.TranscodeRequest) (*dispatch.Task, error) {
+	return r.enqueue(req.UploadID, func(ctx context.Context) (map[string]interface{}, error) {
+		return r.transcode(ctx, req)
+	})
+}
+
+func (r *Runner) DispatchAudio(ctx context.Context, req dispatch.AudioRequest) (*dispatch.Task, error) {
+	return r.enqueue(req.UploadID, func(ctx context.Context) (map[string]interface{}, error) {
+		return r.packageAudio(ctx, req)
+	})
+}
+
+func (r *Runner) enqueue(jobID string, work func(ctx context.Context) (map[string]interface{}, error)) (*dispatch.Task, error) {
+	t := &task{
+		jobID:  jobID,
+		work:   work,
+		result: dispatch.TaskResult{TaskID: uuid.New().String(), State: dispatch.StatePending},
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case r.queue <- t:
+	default:
+		return nil, errQueueFull
+	}
+	r.tasks[t.result.TaskID] = t
+	return &dispatch.Task{ID: t.result.TaskID, Queue: queueName}, nil
+}
+
+// Revoke skips a waiting task, a running one is killed when terminate is set
+func (r *Runner) Revoke(ctx context.Context, taskID string, terminate bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tasks[taskID]
+	if !ok {
+		return nil
+	}
+	switch t.result.State {
+	case dispatch.StatePending:
+		t.revoked = true
+		r.finish(t, dispatch.StateRevoked)
+	case dispatch.StateStarted:
+		if terminate {
+			t.revoked = true
+			t.cancel()
+		}
+	}
+	return nil
+}
+
+func (r *Runner) TaskResult(ctx context.Context, taskID string) (*dispatch.TaskResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tasks[taskID]
+	if !ok {
+		return &dispatch.TaskResult{TaskID: taskID, State: dispatch.StatePending}, nil
+	}
+	res := t.result
+	return &res, nil
+}
+
+func (r *Runner) QueueDepths(ctx context.Context) ([]dispatch.QueueDepth, error) {
+	return []dispatch.QueueDepth{{Name: queueName, Depth: int64(len(r.queue))}}, nil
+}
+
+func (r *Runner) work() {
+	for t := range r.queue {
+		r.run(t)
+	}
+}
+
+func (r *Runner) run(t *task) {
+	r.mu.Lock()
+	if t.revoked {
+		r.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.cancel = cancel
+	t.result.State = dispatch.StateStarted
+	r.mu.Unlock()
+
+	result, err := t.work(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case t.revoked:
+		log.Printf("Local task %s of %s was revoked", t.result.TaskID, t.jobID)
+		r.finish(t, dispatch.StateRevoked)
+	case err != nil:
+		log.Printf("Local task %s of %s failed: %v", t.result.TaskID, t.jobID, err)
+		t.result.Error = taskError(err)
+		r.finish(t, dispatch.StateFailure)
+	default:
+		t.result.Result = result
+		r.finish(t, dispatch.StateSuccess)
+	}
+}
+
+// marks the task done and schedules it to be forgotten, r.mu must be held
+func (r *Runner) finish(t *task, state string) {
+	t.result.State = state
+	t.result.DoneAt = time.Now().UTC().Format(time.RFC3339)
+
+	taskID := t.result.TaskID
+	time.AfterFunc(resultTTL, func() {
+		r.mu.Lock()
+		delete(r.tasks, taskID)
+		r.mu.Unlock()
+	})
+}
@@ -0,0 +1,545 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/dash"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/jobs"
+	"keyflicks_app/internals/m3u8"
+	"keyflicks_app/internals/probe"
+	"keyflicks_app/internals/profiles"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPU encoders per profile codec, the python worker uses the NVENC ones
+var encoders = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+	"av1":  "libsvtav1",
+}
+
+// speed presets of the encoders, SVT-AV1 numbers them instead of naming them
+var presets = map[string]string{
+	"libx264":   "veryfast",
+	"libx265":   "veryfast",
+	"libsvtav1": "10",
+}
+
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".json": "application/json",
+	".jpg":  "image/jpeg",
+	".vtt":  "text/vtt",
+}
+
+const (
+	// folder below the output prefix the still images are written to
+	thumbsDir = "thumbs"
+	// largest poster height, the poster is never upscaled
+	posterMaxHeight = 720
+	thumbWidth      = 320
+
+	// scrub preview sprites, same layout as worker_application/app/thumbnails.py
+	spriteWidth    = 160
+	spriteHeight   = 90
+	spriteColumns  = 10
+	spriteRows     = 10
+	spriteInterval = 5.0
+	spriteMaxCells = 300
+)
+
+// codedError carries the error code reported in failed events, like the
+// exception class name the python worker sends
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func taskError(err error) *dispatch.TaskError {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return &dispatch.TaskError{Type: ce.code, Message: ce.err.Error()}
+	}
+	return &dispatch.TaskError{Type: "RunnerError", Message: err.Error()}
+}
+
+// transcode produces the HLS renditions of one job below req.OutputPrefix,
+// the same layout the python worker writes
+func (r *Runner) transcode(ctx context.Context, req dispatch.TranscodeRequest) (map[string]interface{}, error) {
+	profile := req.Profile
+	outputPrefix := strings.TrimSuffix(req.OutputPrefix, "/")
+	if outputPrefix == "" {
+		outputPrefix = path.Join("videos", req.UploadID)
+	}
+
+	rep := newReporter(r.bus, req.UploadID, names(profile))
+	rep.status("processing", "", "")
+
+	err := r.produce(ctx, req, profile, outputPrefix, rep)
+	if err != nil {
+		// revoked tasks are reported as cancelled by whoever revoked them
+		if ctx.Err() == nil {
+			te := taskError(err)
+			rep.status("failed", te.Type, te.Message)
+		}
+		return nil, err
+	}
+
+	rep.status("ready", "", "")
+	return map[string]interface{}{
+		"status":        "success",
+		"upload_id":     req.UploadID,
+		"output_prefix": outputPrefix,
+		"renditions":    names(profile),
+	}, nil
+}
+
+func (r *Runner) produce(ctx context.Context, req dispatch.TranscodeRequest, profile profiles.Profile, outputPrefix string, rep *reporter) error {
+	workDir, err := os.MkdirTemp("", "transcode-"+req.UploadID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	url, err := r.S3.GeneratePresignedGetUrl(ctx, r.pending_bucket, req.S3Key, time.Hour)
+	if err != nil {
+		return &codedError{code: "S3Error", err: err}
+	}
+
+	rep.setStage("probing")
+	var duration float64
+	if info, err := probe.Probe(ctx, url); err == nil {
+		duration = info.Duration
+	}
+
+	// the key stays in the work folder, only its URI ends up in the playlists
+	keyInfo := ""
+	if req.Encryption != nil {
+		keyInfo, err = writeKeyInfo(workDir, req.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	rep.setStage("transcoding")
+	for _, rend := range profile.Renditions {
+		rep.rendition(rend.Name, "running", -1)
+		outDir := filepath.Join(workDir, rend.Name)
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			return err
+		}
+		err := runFFmpeg(ctx, ffmpegArgs(url, profile, rend, outDir, keyInfo), duration, func(pct float64) {
+			rep.rendition(rend.Name, "", pct)
+		})
+		if err != nil {
+			rep.rendition(rend.Name, "failed", -1)
+			return &codedError{code: "FFmpegError", err: fmt.Errorf("rendition %s: %w", rend.Name, err)}
+		}
+		rep.rendition(rend.Name, "done", -1)
+	}
+
+	// stills and sprites are extras, the renditions are served without them.
+	// What could not be made is listed in the metadata
+	rep.setStage("thumbnails")
+	stillsDir := filepath.Join(workDir, thumbsDir)
+	warnings := map[string]string{}
+	if err := generateStills(ctx, url, stillsDir, posterTime(duration, req.PosterAt)); err != nil {
+		log.Printf("Local transcode of %s: no poster: %v", req.UploadID, err)
+		warnings["thumbnails"] = err.Error()
+	}
+	if err := generateSprites(ctx, url, stillsDir, duration); err != nil {
+		log.Printf("Local transcode of %s: no sprites: %v", req.UploadID, err)
+		warnings["sprites"] = err.Error()
+	}
+
+	// a missing description must not fail an otherwise good transcode
+	if err := writeMetadata(ctx, url, req.SizeBytes, profile, workDir, warnings); err != nil {
+		log.Printf("Local transcode of %s: no media metadata: %v", req.UploadID, err)
+	}
+
+	rep.setStage("uploading")
+	dirs := names(profile)
+	if _, err := os.Stat(stillsDir); err == nil {
+		dirs = append(dirs, thumbsDir)
+	}
+	for _, dir := range dirs {
+		if err := r.uploadDir(ctx, filepath.Join(workDir, dir), path.Join(outputPrefix, dir)); err != nil {
+			return &codedError{code: "S3Error", err: err}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, jobs.MetadataFile)); err == nil {
+		if err := r.uploadFile(ctx, filepath.Join(workDir, jobs.MetadataFile), path.Join(outputPrefix, jobs.MetadataFile)); err != nil {
+			return &codedError{code: "S3Error", err: err}
+		}
+	}
+
+	// CMAF renditions are listed in a DASH manifest as well, the segments are shared.
+	// Players would need CENC rather than AES-128 to decrypt them, so encrypted ones are HLS only.
+	if profile.FMP4() && !profile.SingleFile && req.Encryption == nil {
+		manifest, err := dashManifest(profile, workDir)
+		if err != nil {
+			return &codedError{code: "PackagingError", err: err}
+		}
+		if err := r.S3.PutObject(ctx, r.streaming_bucket, path.Join(outputPrefix, dash.ManifestFile), bytes.NewReader(manifest), "application/dash+xml"); err != nil {
+			return &codedError{code: "S3Error", err: err}
+		}
+	}
+
+	master := masterPlaylist(profile)
+	if err := r.S3.PutObject(ctx, r.streaming_bucket, path.Join(outputPrefix, "master.m3u8"), strings.NewReader(master), contentTypes[".m3u8"]); err != nil {
+		return &codedError{code: "S3Error", err: err}
+	}
+	return nil
+}
+
+// writeMetadata describes the original and every rendition in workDir/metadata.json,
+// along with the warnings about the outputs that could not be made
+func writeMetadata(ctx context.Context, input string, sizeBytes int64, profile profiles.Profile, workDir string, warnings map[string]string) error {
+	original, err := probe.Extract(ctx, input)
+	if err != nil {
+		return err
+	}
+	if original.SizeBytes == 0 {
+		original.SizeBytes = sizeBytes
+	}
+	media := probe.MediaInfo{Original: original, Renditions: map[string]*probe.Metadata{}}
+	if len(warnings) > 0 {
+		media.Warnings = warnings
+	}
+
+	for _, name := range names(profile) {
+		dir := filepath.Join(workDir, name)
+		md, err := probe.Extract(ctx, filepath.Join(dir, "playlist.m3u8"))
+		if err != nil {
+			return fmt.Errorf("rendition %s: %w", name, err)
+		}
+		// ffprobe only sees the playlist, the size is the sum of its segments
+		md.SizeBytes, err = dirSize(dir)
+		if err != nil {
+			return err
+		}
+		if md.Duration > 0 {
+			md.Bitrate = int64(float64(md.SizeBytes*8) / md.Duration)
+		}
+		media.Renditions[name] = md
+	}
+
+	data, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(workDir, jobs.MetadataFile), data, 0o644)
+}
+
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		if !entry.IsDir() {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+func names(profile profiles.Profile) []string {
+	out := make([]string, 0, len(profile.Renditions))
+	for _, rend := range profile.Renditions {
+		out = append(out, rend.Name)
+	}
+	return out
+}
+
+// second the poster frame is taken from, same rules as the python worker
+func posterTime(duration float64, posterAt *float64) float64 {
+	if posterAt != nil {
+		t := math.Max(0, *posterAt)
+		if duration > 0 {
+			t = math.Min(t, math.Max(0, duration-0.1))
+		}
+		return t
+	}
+	// skip black intro frames, 10% in is usually representative
+	if duration > 0 {
+		return duration * 0.1
+	}
+	return 1
+}
+
+// writes poster.jpg and the small thumb.jpg of the same frame into outDir
+func generateStills(ctx context.Context, input string, outDir string, at float64) error {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-y", "-v", "error",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", posterMaxHeight), "-q:v", "3",
+		filepath.Join(outDir, "poster.jpg"),
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", thumbWidth), "-q:v", "4",
+		filepath.Join(outDir, "thumb.jpg"),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+// writes the sprite_NNN.jpg sheets and sprites.vtt into outDir,
+// without a known duration no track can be built and nothing is written
+func generateSprites(ctx context.Context, input string, outDir string, duration float64) error {
+	if duration <= 0 {
+		return nil
+	}
+	interval := math.Max(spriteInterval, duration/spriteMaxCells)
+	filter := fmt.Sprintf("fps=1/%.3f,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		interval, spriteWidth, spriteHeight, spriteWidth, spriteHeight, spriteColumns, spriteRows)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-y", "-v", "error",
+		"-i", input,
+		"-an",
+		"-vf", filter,
+		"-q:v", "5",
+		filepath.Join(outDir, "sprite_%03d.jpg"),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	return os.WriteFile(filepath.Join(outDir, "sprites.vtt"), []byte(spriteVTT(duration, interval)), 0o644)
+}
+
+// WebVTT track mapping each interval to its cell, image references are relative to the thumbs folder
+func spriteVTT(duration float64, interval float64) string {
+	perSheet := spriteColumns * spriteRows
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; float64(i)*interval < duration; i++ {
+		start := float64(i) * interval
+		end := math.Min(start+interval, duration)
+		sheet, cell := i/perSheet, i%perSheet
+		row, col := cell/spriteColumns, cell%spriteColumns
+		fmt.Fprintf(&b, "%s --> %s\n", vttTimestamp(start), vttTimestamp(end))
+		fmt.Fprintf(&b, "sprite_%03d.jpg#xywh=%d,%d,%d,%d\n\n", sheet+1, col*spriteWidth, row*spriteHeight, spriteWidth, spriteHeight)
+	}
+	return b.String()
+}
+
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func ffmpegArgs(input string, profile profiles.Profile, rend profiles.Rendition, outDir string, keyInfo string) []string {
+	encoder, ok := encoders[profile.Codec]
+	if !ok {
+		encoder = encoders["h264"]
+	}
+	segment := profile.SegmentDuration
+	if segment <= 0 {
+		segment = 6
+	}
+
+	args := []string{
+		"-y", "-v", "error",
+		"-i", input,
+		"-vf", fmt.Sprintf("scale=-2:%d", rend.Height),
+		"-c:v", encoder,
+		"-preset", presets[encoder],
+		"-b:v", strconv.Itoa(rend.VideoBitrate),
+		"-maxrate", strconv.Itoa(rend.VideoBitrate * 3 / 2),
+		"-bufsize", strconv.Itoa(rend.VideoBitrate * 2),
+		"-g", "48",
+		"-keyint_min", "48",
+		"-sc_threshold", "0",
+		"-c:a", "aac",
+		"-b:a", strconv.Itoa(rend.AudioBitrate),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segment),
+		"-hls_playlist_type", "vod",
+	}
+	args = append(args, hlsSegmentArgs(profile, outDir)...)
+	if keyInfo != "" {
+		args = append(args, "-hls_key_info_file", keyInfo)
+	}
+	return append(args, filepath.Join(outDir, "playlist.m3u8"))
+}
+
+// writeKeyInfo writes the content key and the key info file ffmpeg's HLS muxer
+// encrypts the segments with. Without an IV line the media sequence number is used.
+func writeKeyInfo(workDir string, enc *dispatch.Encryption) (string, error) {
+	keyPath := filepath.Join(workDir, "content.key")
+	if err := os.WriteFile(keyPath, enc.Key, 0o600); err != nil {
+		return "", err
+	}
+	infoPath := filepath.Join(workDir, "content.keyinfo")
+	if err := os.WriteFile(infoPath, []byte(enc.KeyURI+"\n"+keyPath+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return infoPath, nil
+}
+
+// segment container and naming of the HLS muxer, the python worker uses the same layout
+func hlsSegmentArgs(profile profiles.Profile, outDir string) []string {
+	var args []string
+	ext := ".ts"
+	if profile.FMP4() {
+		ext = ".m4s"
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4")
+		if profile.Codec == "hevc" {
+			// Apple players only accept HEVC tagged as hvc1
+			args = append(args, "-tag:v", "hvc1")
+		}
+	}
+	if profile.SingleFile {
+		return append(args, "-hls_flags", "single_file", "-hls_segment_filename", filepath.Join(outDir, "stream"+ext))
+	}
+	return append(args, "-hls_segment_filename", filepath.Join(outDir, "seg_%03d"+ext))
+}
+
+// runFFmpeg runs ffmpeg with machine readable progress on stdout
+// and calls onProgress(percent) as the encode advances
+func runFFmpeg(ctx context.Context, args []string, duration float64, onProgress func(float64)) error {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if key != "out_time_us" || duration <= 0 {
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+			onProgress(float64(us) / 1e6 / duration * 100)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+func (r *Runner) uploadDir(ctx context.Context, localDir string, prefix string) error {
+	entries, err := os.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := r.uploadFile(ctx, filepath.Join(localDir, entry.Name()), path.Join(prefix, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) uploadFile(ctx context.Context, localPath string, key string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType, ok := contentTypes[filepath.Ext(localPath)]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	return r.S3.PutObject(ctx, r.streaming_bucket, key, f, contentType)
+}
+
+// dashManifest lists the fMP4 renditions in workDir in a DASH manifest
+func dashManifest(profile profiles.Profile, workDir string) ([]byte, error) {
+	tracks := make([]dash.Track, 0, len(profile.Renditions))
+	for _, rend := range profile.Renditions {
+		data, err := os.ReadFile(filepath.Join(workDir, rend.Name, "playlist.m3u8"))
+		if err != nil {
+			return nil, err
+		}
+		playlist, err := m3u8.Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, dash.Track{
+			ID:        rend.Name,
+			Bandwidth: rend.Bandwidth(),
+			Width:     rend.Width,
+			Height:    rend.Height,
+			Playlist:  playlist,
+		})
+	}
+
+	mpd, err := dash.Build(profile.Codec, tracks)
+	if err != nil {
+		return nil, err
+	}
+	return mpd.Marshal()
+}
+
+// same master playlist the python worker writes
+func masterPlaylist(profile profiles.Profile) string {
+	lines := []string{"#EXTM3U", fmt.Sprintf("#EXT-X-VERSION:%d", profile.HLSVersion())}
+	for _, rend := range profile.Renditions {
+		lines = append(lines,
+			fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d", rend.Bandwidth(), rend.Width, rend.Height),
+			rend.Name+"/playlist.m3u8",
+		)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,12 +2,14 @@ package s3_store
 
 import (
 	"context"
+	"errors"
 	"io"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type S3Store struct {
@@ -76,3 +78,83 @@ func (s *S3Store) ListObjects(ctx context.Context, bucket string, prefix string)
 	// exactly like Python's resp.get("Contents", []).
 	return output.Contents, nil
 }
+
+// Exists looks a single object up with a HEAD request
+func (s *S3Store) Exists(ctx context.Context, bucket string, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	// HEAD responses have no body, a missing object only shows as NotFound
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+		return false, nil
+	}
+	return false, err
+}
+
+// DeletePrefix removes every object whose key starts with prefix
+func (s *S3Store) DeletePrefix(ctx context.Context, bucket string, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		// a list page holds at most 1000 keys, which is also the DeleteObjects limit
+		ids := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: obj.Key})
+		}
+
+		_, err = s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// presigned get url, e.g. for letting ffprobe read a private object
+func (s *S3Store) GeneratePresignedGetUrl(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	presigned_url, err := s.presignedClient.PresignGetObject(ctx, input, func(po *s3.PresignOptions) {
+		po.Expires = expires
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return presigned_url.URL, nil
+}
+
+// PutObject uploads body under key
+func (s *S3Store) PutObject(ctx context.Context, bucket string, key string, body io.Reader, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+
+	_, err := s.client.PutObject(ctx, input)
+	return err
+}
@@ -0,0 +1,69 @@
+package signature
+
+import (
+	"keyflicks_app/internals/dash"
+	"path"
+	"strings"
+)
+
+// RewriteManifest signs the segments of a DASH manifest. The BaseURL of every
+// representation becomes the URL of videos/<id>/<versionDir>/<rendition>/ and its
+// SegmentTemplate is expanded into a SegmentList, since every segment needs
+// a signature of its own. The segments expire as expiry says from their
+// SegmentTimeline start time, init segments with the last one.
+// Video representations keep returns false for are dropped, nil keeps them all.
+func RewriteManifest(manifest []byte, videoID string, versionDir string, expiry Expiry, uri_secret string, urls URLs, keep func(rep *dash.Representation) bool) ([]byte, error) {
+	mpd, err := dash.Parse(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, period := range mpd.Periods {
+		for _, set := range period.AdaptationSets {
+			if keep != nil && set.IsVideo() && len(set.Representations) > 0 {
+				kept := set.Representations[:0]
+				for _, rep := range set.Representations {
+					if keep(rep) {
+						kept = append(kept, rep)
+					}
+				}
+				if len(kept) == 0 {
+					return nil, ErrNoRenditions
+				}
+				set.Representations = kept
+			}
+
+			for _, rep := range set.Representations {
+				if rep.SegmentTemplate == nil {
+					continue
+				}
+				init, media, err := rep.Expand()
+				if err != nil {
+					return nil, err
+				}
+
+				base := strings.TrimSuffix(urls.SegmentPublicPath(videoID, path.Join(versionDir, rep.BaseURL)), "/") + "/"
+				sign := func(file string, expires int64) string {
+					return strings.TrimPrefix(SignPath(base+file, expires, uri_secret), base)
+				}
+				starts, total := rep.Starts()
+
+				list := &dash.SegmentList{
+					Timescale: rep.SegmentTemplate.Timescale,
+					Timeline:  rep.SegmentTemplate.Timeline,
+				}
+				if init != "" {
+					list.Initialization = &dash.URL{SourceURL: sign(init, expiry.At(total))}
+				}
+				for i, m := range media {
+					list.SegmentURLs = append(list.SegmentURLs, dash.SegmentURL{Media: sign(m, expiry.At(starts[i]))})
+				}
+
+				rep.BaseURL = strings.TrimSuffix(urls.SegmentHost, "/") + base
+				rep.SegmentTemplate = nil
+				rep.SegmentList = list
+			}
+		}
+	}
+	return mpd.Marshal()
+}
@@ -0,0 +1,111 @@
+package signature
+
+import (
+	"errors"
+	"keyflicks_app/internals/dash"
+	"strings"
+	"testing"
+)
+
+// two renditions of 6, 6, 6 and 4.5 seconds as the worker writes them
+const workerManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="static" mediaPresentationDuration="PT22.500S" minBufferTime="PT2S">
+  <Period id="0" start="PT0S">
+    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true">
+      <Representation id="360p" bandwidth="800000" width="640" height="360" codecs="avc1.640028,mp4a.40.2">
+        <BaseURL>360p/</BaseURL>
+        <SegmentTemplate timescale="1000" initialization="init.mp4" media="seg_$Number%03d$.m4s" startNumber="0">
+          <SegmentTimeline><S d="6000" r="2"/><S d="4500"/></SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+      <Representation id="720p" bandwidth="2800000" width="1280" height="720" codecs="avc1.640028,mp4a.40.2">
+        <BaseURL>720p/</BaseURL>
+        <SegmentTemplate timescale="1000" initialization="init.mp4" media="seg_$Number%03d$.m4s" startNumber="0">
+          <SegmentTimeline><S d="6000" r="2"/><S d="4500"/></SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+func TestRewriteManifest(t *testing.T) {
+	urls := URLs{SegmentHost: "https://cdn.example.com/"}
+	tests := []struct {
+		name   string
+		expiry Expiry
+		init   int64
+		media  []int64
+	}{
+		{"fixed", Expiry{Issued: 1000, TTL: 60}, 1060, []int64{1060, 1060, 1060, 1060}},
+		{"position aware", Expiry{Issued: 1000, TTL: 60, PositionAware: true}, 1083, []int64{1060, 1066, 1072, 1078}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := RewriteManifest([]byte(workerManifest), "vid", "v2", tt.expiry, "secret", urls, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mpd, err := dash.Parse(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reps := mpd.Periods[0].AdaptationSets[0].Representations
+			if len(reps) != 2 {
+				t.Fatalf("got %d representations, want 2", len(reps))
+			}
+			for _, rep := range reps {
+				base := "/videos/vid/v2/" + rep.ID + "/"
+				if rep.BaseURL != "https://cdn.example.com"+base {
+					t.Errorf("%s: BaseURL = %s", rep.ID, rep.BaseURL)
+				}
+				if rep.SegmentTemplate != nil || rep.SegmentList == nil {
+					t.Fatalf("%s: template not replaced by a list", rep.ID)
+				}
+				list := rep.SegmentList
+				if list.Timescale != 1000 || list.Timeline.Count() != 4 {
+					t.Errorf("%s: list lost its timing, timescale %d", rep.ID, list.Timescale)
+				}
+
+				if want := strings.TrimPrefix(SignPath(base+"init.mp4", tt.init, "secret"), base); list.Initialization.SourceURL != want {
+					t.Errorf("%s: init = %s, want %s", rep.ID, list.Initialization.SourceURL, want)
+				}
+				if len(list.SegmentURLs) != len(tt.media) {
+					t.Fatalf("%s: got %d segments, want %d", rep.ID, len(list.SegmentURLs), len(tt.media))
+				}
+				for i, exp := range tt.media {
+					file := []string{"seg_000.m4s", "seg_001.m4s", "seg_002.m4s", "seg_003.m4s"}[i]
+					if want := strings.TrimPrefix(SignPath(base+file, exp, "secret"), base); list.SegmentURLs[i].Media != want {
+						t.Errorf("%s: segment %d = %s, want %s", rep.ID, i, list.SegmentURLs[i].Media, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteManifestFilter(t *testing.T) {
+	sd := func(rep *dash.Representation) bool { return rep.Height <= 360 }
+	out, err := RewriteManifest([]byte(workerManifest), "vid", "v2", Expiry{Issued: 1000, TTL: 60}, "secret", URLs{}, sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpd, err := dash.Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reps := mpd.Periods[0].AdaptationSets[0].Representations
+	if len(reps) != 1 || reps[0].ID != "360p" {
+		t.Fatalf("kept %d representations, want only 360p", len(reps))
+	}
+	if reps[0].BaseURL != "/videos/vid/v2/360p/" {
+		t.Errorf("BaseURL = %s", reps[0].BaseURL)
+	}
+
+	none := func(rep *dash.Representation) bool { return false }
+	if _, err := RewriteManifest([]byte(workerManifest), "vid", "v2", Expiry{}, "secret", URLs{}, none); !errors.Is(err, ErrNoRenditions) {
+		t.Errorf("got %v, want ErrNoRenditions", err)
+	}
+}
@@ -0,0 +1,24 @@
+package signature
+
+import "math"
+
+// Expiry decides the st of the URLs signed into a playlist or manifest
+type Expiry struct {
+	// unix time the playlist is handed out
+	Issued int64
+	// seconds the URLs stay valid, the grace window after the start
+	// time of their segment when PositionAware
+	TTL int64
+	// every segment expires TTL after the viewer reaches it instead of
+	// all of them TTL after Issued, so long videos play through without
+	// a playlist refetch and early segments don't stay valid for hours
+	PositionAware bool
+}
+
+// At returns the expiry of a segment starting start seconds into the playlist
+func (e Expiry) At(start float64) int64 {
+	if !e.PositionAware {
+		return e.Issued + e.TTL
+	}
+	return e.Issued + int64(math.Ceil(start)) + e.TTL
+}
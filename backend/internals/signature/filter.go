@@ -0,0 +1,23 @@
+package signature
+
+import (
+	"errors"
+	"keyflicks_app/internals/m3u8"
+)
+
+// returned when filtering left no video rendition to play
+var ErrNoRenditions = errors.New("no rendition left")
+
+// FilterVariants drops the variant streams of a master playlist keep returns false for
+func FilterVariants(playlistContent string, keep func(v m3u8.Variant) bool) (string, error) {
+	playlist, err := m3u8.Parse(playlistContent)
+	if err != nil {
+		return "", err
+	}
+	had := len(playlist.Variants())
+	playlist.FilterVariants(keep)
+	if had > 0 && len(playlist.Variants()) == 0 {
+		return "", ErrNoRenditions
+	}
+	return playlist.String(), nil
+}
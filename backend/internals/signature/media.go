@@ -0,0 +1,59 @@
+package signature
+
+import "keyflicks_app/internals/m3u8"
+
+// MediaRendition is one EXT-X-MEDIA entry of an alternative rendition group
+type MediaRendition struct {
+	Type     string // AUDIO or SUBTITLES
+	GroupID  string
+	Name     string
+	Language string
+	Default  bool
+	// empty for renditions muxed into the variant streams
+	URI string
+}
+
+func (m MediaRendition) tag() *m3u8.Tag {
+	t := &m3u8.Tag{Name: m3u8.TagMedia}
+	t.SetAttr("TYPE", m.Type, false)
+	t.SetAttr("GROUP-ID", m.GroupID, true)
+	t.SetAttr("NAME", m.Name, true)
+	if m.Language != "" {
+		t.SetAttr("LANGUAGE", m.Language, true)
+	}
+	if m.Default {
+		t.SetAttr("DEFAULT", "YES", false)
+	} else {
+		t.SetAttr("DEFAULT", "NO", false)
+	}
+	t.SetAttr("AUTOSELECT", "YES", false)
+	if m.URI != "" {
+		t.SetAttr("URI", m.URI, true)
+	}
+	return t
+}
+
+// AddMediaGroup declares the renditions in the master playlist and makes every
+// variant stream reference their group, e.g. SUBTITLES="subs"
+func AddMediaGroup(playlistContent string, renditions []MediaRendition) (string, error) {
+	if len(renditions) == 0 {
+		return playlistContent, nil
+	}
+	playlist, err := m3u8.Parse(playlistContent)
+	if err != nil {
+		return "", err
+	}
+
+	tags := make([]*m3u8.Tag, 0, len(renditions))
+	for _, r := range renditions {
+		tags = append(tags, r.tag())
+	}
+	// the media tags go before the first variant stream
+	playlist.InsertBeforeVariants(tags...)
+
+	groupType, groupID := renditions[0].Type, renditions[0].GroupID
+	for _, inf := range playlist.Tags(m3u8.TagStreamInf) {
+		inf.SetAttr(groupType, groupID, true)
+	}
+	return playlist.String(), nil
+}
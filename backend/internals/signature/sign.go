@@ -4,7 +4,8 @@ import (
 	"crypto/md5"
 	"encoding/base64"
 	"fmt"
-	"regexp"
+	"keyflicks_app/internals/m3u8"
+	"path"
 	"strings"
 )
 
@@ -18,53 +19,81 @@ func signURI(pathURI string, expiresTS int64, uri_secret string) string {
 	return md5Hex(raw)
 }
 
-var playlistLineRe = regexp.MustCompile(`(?m)^([^#\s].*)$`)
+// SignPath returns the public path with the st/sig query nginx's secure_link checks
+func SignPath(publicPath string, expires int64, uri_secret string) string {
+	sig := signURI(publicPath, expires, uri_secret)
+	return fmt.Sprintf("%s?st=%d&sig=%s", publicPath, expires, sig)
+}
 
-func RewritePlaylist(playlistContent string, videoID string, resolutionPath string, expires int64, uri_secret string) string {
-	replacer := func(line string) string {
-		segmentFile := line
-		publicPath := fmt.Sprintf("/videos/%s/%s/%s", videoID, resolutionPath, segmentFile)
-		sig := signURI(publicPath, expires, uri_secret)
-		return fmt.Sprintf("%s?st=%d&sig=%s", publicPath, expires, sig)
-	}
-	return playlistLineRe.ReplaceAllStringFunc(playlistContent, replacer)
+// absolute references point somewhere else (or were rewritten already) and are left alone
+func isAbsolute(uri string) bool {
+	return strings.HasPrefix(uri, "/") || strings.Contains(uri, "://")
 }
 
-func RewriteMasterPlaylist(playlistContent string, videoID string) string {
-	// 1. Split the playlist content into individual lines.
-	// Equivalent to Python's `playlist_content.splitlines()`
-	lines := strings.Split(playlistContent, "\n")
+// RewritePlaylist signs every segment of a media playlist, including the
+// URI of its EXT-X-MAP tags. Relative references are resolved against the
+// rendition folder videos/<id>/<resolutionPath>/ and served as urls says.
+// The URIs of EXT-X-KEY tags are passed to keyURI instead, nil signs them like segments.
+// Segments expire as expiry says from their #EXTINF start time, the EXT-X-MAP and
+// EXT-X-KEY URIs are needed until the end and get the expiry of the last segment.
+func RewritePlaylist(playlistContent string, videoID string, resolutionPath string, expiry Expiry, uri_secret string, urls URLs, keyURI func(uri string, expires int64) string) (string, error) {
+	playlist, err := m3u8.Parse(playlistContent)
+	if err != nil {
+		return "", err
+	}
 
-	// 2. Create a slice to hold the new, rewritten lines.
-	rewrittenLines := make([]string, 0, len(lines))
+	segments := playlist.Segments()
+	starts := make([]float64, len(segments))
+	var total float64
+	for i, s := range segments {
+		starts[i] = total
+		total += s.Duration
+	}
+	last := expiry.At(total)
 
-	// 3. Loop through each line, just like the Python list comprehension.
-	for _, line := range lines {
-		// Equivalent to `if line.strip() == "" or line.startswith("#"):`
-		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
-			// If the line is a comment or empty, add it unchanged.
-			rewrittenLines = append(rewrittenLines, line)
-			continue
+	next := 0
+	err = playlist.RewriteURIs(func(ref m3u8.URIRef) (string, error) {
+		expires := last
+		if ref.Line() && next < len(starts) {
+			expires = expiry.At(starts[next])
+			next++
 		}
 
-		// Equivalent to `parts = line.split('/', 1)`
-		// We split into at most 2 parts to get the resolution directory.
-		parts := strings.SplitN(trimmedLine, "/", 2) // trimmedLine is like eg: "360p/playlist.m3u8"
-		if len(parts) == 0 {
-			continue // Should not happen, but a safe check
+		if keyURI != nil && ref.Tag != nil && ref.Tag.Name == m3u8.TagKey {
+			return keyURI(ref.URI, last), nil
 		}
-		resolutionDir := parts[0]
-
-		// Equivalent to `f"/api/playlist/{video_id}/{resolution_dir.lstrip('/').rstrip('/')}"`
-		// We use fmt.Sprintf for formatting.
-		playlistPath := fmt.Sprintf("/api/playlist/%s/%s", videoID, resolutionDir)
+		if strings.Contains(ref.URI, "://") {
+			return ref.URI, nil
+		}
+		if strings.HasPrefix(ref.URI, "/") {
+			return strings.TrimSuffix(urls.SegmentHost, "/") + SignPath(ref.URI, expires, uri_secret), nil
+		}
+		return urls.SignSegment(videoID, path.Join(resolutionPath, ref.URI), expires, uri_secret), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return playlist.String(), nil
+}
 
-		// Add the rewritten line to our slice.
-		rewrittenLines = append(rewrittenLines, playlistPath)
+// RewriteMasterPlaylist points the variant streams and the EXT-X-MEDIA renditions
+// of a master playlist at the signed playlist endpoint, e.g. "360p/playlist.m3u8"
+// becomes /api/playlist/<id>/360p
+func RewriteMasterPlaylist(playlistContent string, videoID string, urls URLs) (string, error) {
+	playlist, err := m3u8.Parse(playlistContent)
+	if err != nil {
+		return "", err
 	}
 
-	// 4. Join the lines back together with newlines and add a final newline.
-	// Equivalent to `"\n".join(rewritten_lines) + "\n"`
-	return strings.Join(rewrittenLines, "\n") + "\n"
+	err = playlist.RewriteURIs(func(ref m3u8.URIRef) (string, error) {
+		if isAbsolute(ref.URI) {
+			return ref.URI, nil
+		}
+		resolutionDir := strings.SplitN(ref.URI, "/", 2)[0]
+		return urls.API(fmt.Sprintf("/playlist/%s/%s", videoID, resolutionDir)), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return playlist.String(), nil
 }
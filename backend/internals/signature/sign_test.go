@@ -0,0 +1,105 @@
+package signature
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExpiryAt(t *testing.T) {
+	fixed := Expiry{Issued: 1000, TTL: 60}
+	aware := Expiry{Issued: 1000, TTL: 60, PositionAware: true}
+	tests := []struct {
+		start float64
+		fixed int64
+		aware int64
+	}{
+		{0, 1060, 1060},
+		{6, 1060, 1066},
+		{6.006, 1060, 1067},
+		{12.5, 1060, 1073},
+		{3600, 1060, 4660},
+	}
+
+	for _, tt := range tests {
+		if got := fixed.At(tt.start); got != tt.fixed {
+			t.Errorf("fixed At(%v) = %d, want %d", tt.start, got, tt.fixed)
+		}
+		if got := aware.At(tt.start); got != tt.aware {
+			t.Errorf("position aware At(%v) = %d, want %d", tt.start, got, tt.aware)
+		}
+	}
+}
+
+func TestRewritePlaylistExpiry(t *testing.T) {
+	playlist := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin"`,
+		"#EXTINF:6.006,",
+		"seg_000.m4s",
+		"#EXTINF:6.006,",
+		"seg_001.m4s",
+		"#EXTINF:0.5,",
+		"/static/bumper.m4s",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+
+	tests := []struct {
+		name   string
+		expiry Expiry
+		media  []int64 // st of each segment line
+		last   int64   // st of the map and the key
+	}{
+		// starts 0, 6.006 and 12.012, 12.512 in total
+		{"fixed", Expiry{Issued: 1000, TTL: 60}, []int64{1060, 1060, 1060}, 1060},
+		{"position aware", Expiry{Issued: 1000, TTL: 60, PositionAware: true}, []int64{1060, 1067, 1073}, 1073},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keyExpires int64
+			keyURI := func(uri string, expires int64) string {
+				keyExpires = expires
+				return "/api/keys/vid?st=" + strconv.FormatInt(expires, 10)
+			}
+			out, err := RewritePlaylist(playlist, "vid", "360p", tt.expiry, "secret", URLs{SegmentHost: "https://cdn.example.com"}, keyURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cdn := "https://cdn.example.com"
+			want := strings.Join([]string{
+				"#EXTM3U",
+				"#EXT-X-VERSION:7",
+				`#EXT-X-MAP:URI="` + cdn + SignPath("/videos/vid/360p/init.mp4", tt.last, "secret") + `"`,
+				`#EXT-X-KEY:METHOD=AES-128,URI="/api/keys/vid?st=` + strconv.FormatInt(tt.last, 10) + `"`,
+				"#EXTINF:6.006,",
+				cdn + SignPath("/videos/vid/360p/seg_000.m4s", tt.media[0], "secret"),
+				"#EXTINF:6.006,",
+				cdn + SignPath("/videos/vid/360p/seg_001.m4s", tt.media[1], "secret"),
+				"#EXTINF:0.5,",
+				cdn + SignPath("/static/bumper.m4s", tt.media[2], "secret"),
+				"#EXT-X-ENDLIST",
+			}, "\n") + "\n"
+			if out != want {
+				t.Errorf("got\n%s\nwant\n%s", out, want)
+			}
+			if keyExpires != tt.last {
+				t.Errorf("key expires %d, want %d", keyExpires, tt.last)
+			}
+		})
+	}
+}
+
+func TestRewritePlaylistSignsKeyWithoutCallback(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:4,\nseg.ts\n"
+	out, err := RewritePlaylist(playlist, "vid", "360p", Expiry{Issued: 1000, TTL: 60, PositionAware: true}, "secret", URLs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := SignPath("/videos/vid/360p/key.bin", 1064, "secret"); !strings.Contains(out, `URI="`+want+`"`) {
+		t.Errorf("key not signed with the last expiry\n%s", out)
+	}
+}
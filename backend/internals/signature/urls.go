@@ -0,0 +1,96 @@
+package signature
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+const (
+	DefaultSegmentPath = "/videos/{video_id}/{path}"
+	DefaultAPIPrefix   = "/api"
+)
+
+// URLs decides where the rewritten playlists point players to.
+// Empty fields fall back to the host-relative paths nginx serves.
+type URLs struct {
+	// absolute base of the segment URLs, e.g. "https://cdn.example.com"
+	SegmentHost string `json:"segment_host,omitempty"`
+	// path the files of videos/<id>/ are served under, {video_id} and {path} are
+	// replaced. The signatures cover this path, so it has to be the one the
+	// segment server sees.
+	SegmentPath string `json:"segment_path,omitempty"`
+	// absolute base of the playlist, manifest and key URLs
+	APIHost string `json:"api_host,omitempty"`
+	// path the API is mounted under, e.g. "/brand-a/api"
+	APIPrefix string `json:"api_prefix,omitempty"`
+}
+
+// Merge fills the empty fields of u from base
+func (u URLs) Merge(base URLs) URLs {
+	if u.SegmentHost == "" {
+		u.SegmentHost = base.SegmentHost
+	}
+	if u.SegmentPath == "" {
+		u.SegmentPath = base.SegmentPath
+	}
+	if u.APIHost == "" {
+		u.APIHost = base.APIHost
+	}
+	if u.APIPrefix == "" {
+		u.APIPrefix = base.APIPrefix
+	}
+	return u
+}
+
+func (u URLs) withDefaults() URLs {
+	return u.Merge(URLs{SegmentPath: DefaultSegmentPath, APIPrefix: DefaultAPIPrefix})
+}
+
+// SegmentPublicPath is the path a file of videos/<id>/ is served under, p is relative to that folder
+func (u URLs) SegmentPublicPath(videoID string, p string) string {
+	u = u.withDefaults()
+	return strings.NewReplacer("{video_id}", videoID, "{path}", strings.TrimPrefix(p, "/")).Replace(u.SegmentPath)
+}
+
+// SignSegment returns the signed URL of a file of videos/<id>/
+func (u URLs) SignSegment(videoID string, p string, expires int64, uri_secret string) string {
+	return strings.TrimSuffix(u.SegmentHost, "/") + SignPath(u.SegmentPublicPath(videoID, p), expires, uri_secret)
+}
+
+// API returns the URL of an API path like "/playlist/<id>/360p"
+func (u URLs) API(p string) string {
+	u = u.withDefaults()
+	return strings.TrimSuffix(u.APIHost, "/") + "/" + strings.Trim(u.APIPrefix, "/") + p
+}
+
+// CacheKey tells rewritten playlists of different URL settings apart in the cache
+func (u URLs) CacheKey() string {
+	b, _ := json.Marshal(u.withDefaults())
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:6])
+}
+
+// URLSet holds the URL settings of the default deployment and of the
+// white-label hosts that override them
+type URLSet struct {
+	Default URLs
+	// keyed by the host the request was made to, without port
+	Hosts map[string]URLs
+}
+
+// For returns the settings for a request made to host
+func (s *URLSet) For(host string) URLs {
+	if s == nil {
+		return URLs{}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if override, ok := s.Hosts[strings.ToLower(host)]; ok {
+		return override.Merge(s.Default)
+	}
+	return s.Default
+}
@@ -0,0 +1,47 @@
+package signature
+
+import (
+	"path"
+	"strings"
+)
+
+// RewriteVTT signs the image references of a WebVTT thumbnail track.
+// Relative references are resolved against dir, a folder of videos/<id>/ (e.g. "v2/thumbs"),
+// media fragments like "#xywh=0,0,160,90" are kept after the signature.
+func RewriteVTT(vttContent string, videoID string, dir string, expires int64, uri_secret string, urls URLs) string {
+	lines := strings.Split(vttContent, "\n")
+	inCue := false
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			inCue = false
+		case strings.Contains(trimmed, "-->"):
+			inCue = true
+		case inCue:
+			lines[i] = signReference(trimmed, videoID, dir, expires, uri_secret, urls)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func signReference(ref string, videoID string, dir string, expires int64, uri_secret string, urls URLs) string {
+	// absolute urls point somewhere else and are left alone
+	if strings.Contains(ref, "://") {
+		return ref
+	}
+
+	file, fragment, hasFragment := strings.Cut(ref, "#")
+	var signed string
+	if strings.HasPrefix(file, "/") {
+		signed = strings.TrimSuffix(urls.SegmentHost, "/") + SignPath(file, expires, uri_secret)
+	} else {
+		signed = urls.SignSegment(videoID, path.Join(dir, file), expires, uri_secret)
+	}
+
+	if hasFragment {
+		signed += "#" + fragment
+	}
+	return signed
+}
@@ -0,0 +1,162 @@
+package subtitles
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrEmpty     = errors.New("no cues found")
+	ErrNotUTF8   = errors.New("subtitles must be UTF-8 encoded")
+	ErrBadFormat = errors.New("not an SRT or WebVTT file")
+)
+
+// language tags like "en", "pt-BR" or "zh-Hant"
+var langRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// timing line of a cue, SRT uses a comma before the milliseconds and WebVTT a dot.
+// Hours are optional in WebVTT.
+var timingRe = regexp.MustCompile(`^((?:\d+:)?\d{2}:\d{2}[,.]\d{3})\s+-->\s+((?:\d+:)?\d{2}:\d{2}[,.]\d{3})(.*)$`)
+
+// PTS in 90kHz ticks the first video segment starts at. ffmpeg's mpegts muxer
+// shifts the timestamps by 1.4s, fMP4 fragments keep them starting at 0
+const (
+	TSStartPTS   = 126000
+	FMP4StartPTS = 0
+)
+
+// aligns cue times with the video segments
+func timestampMap(startPTS int64) string {
+	return fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000", startPTS)
+}
+
+// prefix of the folder of a subtitle track, e.g. videos/<id>/subs_en/
+const dirPrefix = "subs_"
+
+// Dir is the folder of the track of a language relative to videos/<id>/
+func Dir(lang string) string {
+	return dirPrefix + lang
+}
+
+// IsDir reports whether a rendition folder holds a subtitle track
+func IsDir(dir string) bool {
+	return strings.HasPrefix(dir, dirPrefix)
+}
+
+// ValidLanguage reports whether lang can be used as a track language and folder name
+func ValidLanguage(lang string) bool {
+	return langRe.MatchString(lang)
+}
+
+// Track is a converted subtitle file
+type Track struct {
+	VTT string
+	// end of the last cue in seconds
+	Duration float64
+}
+
+// ToVTT converts an SRT or WebVTT file to WebVTT. Cue time 0 is mapped to
+// startPTS, see TSStartPTS, unless the file brings a timestamp map of its own.
+func ToVTT(data []byte, startPTS int64) (*Track, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return nil, ErrNotUTF8
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	isVTT := strings.HasPrefix(text, "WEBVTT")
+
+	var out []string
+	if !isVTT {
+		out = append(out, "WEBVTT", "")
+	}
+
+	cues := 0
+	var end float64
+	lines := strings.Split(text, "\n")
+	for _, line := range lines {
+		m := timingRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			// SRT cue numbers are valid WebVTT cue identifiers and are kept
+			out = append(out, line)
+			continue
+		}
+
+		cues++
+		if t, err := parseTimestamp(m[2]); err == nil {
+			end = math.Max(end, t)
+		}
+		if isVTT {
+			out = append(out, line)
+			continue
+		}
+		// SRT coordinates (X1:.. Y2:..) have no WebVTT equivalent
+		settings := ""
+		if !strings.Contains(m[3], "X1:") {
+			settings = m[3]
+		}
+		out = append(out, fmt.Sprintf("%s --> %s%s", srtToVTTTime(m[1]), srtToVTTTime(m[2]), settings))
+	}
+
+	if cues == 0 {
+		if !isVTT && !looksLikeSRT(lines) {
+			return nil, ErrBadFormat
+		}
+		return nil, ErrEmpty
+	}
+	if !strings.Contains(text, "X-TIMESTAMP-MAP") {
+		// must sit in the header block, right below the WEBVTT line
+		out = append(out[:1], append([]string{timestampMap(startPTS)}, out[1:]...)...)
+	}
+	return &Track{
+		VTT:      strings.TrimRight(strings.Join(out, "\n"), "\n") + "\n",
+		Duration: end,
+	}, nil
+}
+
+func looksLikeSRT(lines []string) bool {
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		_, err := strconv.Atoi(strings.TrimSpace(line))
+		return err == nil
+	}
+	return false
+}
+
+func srtToVTTTime(ts string) string {
+	return strings.Replace(ts, ",", ".", 1)
+}
+
+// parseTimestamp reads "hh:mm:ss.mmm" or "mm:ss.mmm" (comma or dot) into seconds
+func parseTimestamp(ts string) (float64, error) {
+	ts = srtToVTTTime(ts)
+	parts := strings.Split(ts, ":")
+	var seconds float64
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// Playlist is the single segment HLS media playlist of a subtitle track
+func Playlist(segment string, duration float64) string {
+	target := int(math.Ceil(duration))
+	if target < 1 {
+		target = 1
+	}
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+		target, duration, segment)
+}
@@ -0,0 +1,162 @@
+package subtitles
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func vtt(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
+
+func TestToVTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		duration float64
+	}{
+		{
+			name: "srt",
+			in:   "1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:01:02,123 --> 00:01:04,000\nWorld, again\n",
+			want: vtt(
+				"WEBVTT",
+				timestampMap(TSStartPTS),
+				"",
+				"1",
+				"00:00:01.000 --> 00:00:02.500",
+				"Hello",
+				"",
+				"2",
+				"00:01:02.123 --> 00:01:04.000",
+				"World, again",
+			),
+			duration: 64,
+		},
+		{
+			name: "srt with bom, crlf and coordinates",
+			in:   "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,000 X1:10 X2:20 Y1:5 Y2:6\r\nHi\r\n\r\n",
+			want: vtt(
+				"WEBVTT",
+				timestampMap(TSStartPTS),
+				"",
+				"1",
+				"00:00:01.000 --> 00:00:02.000",
+				"Hi",
+			),
+			duration: 2,
+		},
+		{
+			name: "srt with hours over 99 and old mac line endings",
+			in:   "7\r100:00:00,000 --> 100:00:01,250\rLong\r",
+			want: vtt(
+				"WEBVTT",
+				timestampMap(TSStartPTS),
+				"",
+				"7",
+				"100:00:00.000 --> 100:00:01.250",
+				"Long",
+			),
+			duration: 360001.25,
+		},
+		{
+			name: "vtt keeps its header and cue settings",
+			in:   "WEBVTT - captions\nKind: captions\n\nintro\n00:01.000 --> 00:02.000 align:start\nHi\n",
+			want: vtt(
+				"WEBVTT - captions",
+				timestampMap(TSStartPTS),
+				"Kind: captions",
+				"",
+				"intro",
+				"00:01.000 --> 00:02.000 align:start",
+				"Hi",
+			),
+			duration: 2,
+		},
+		{
+			name: "vtt with a timestamp map is left alone",
+			in:   "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:03.000 --> 00:00:04.500\nHi\n",
+			want: vtt(
+				"WEBVTT",
+				"X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000",
+				"",
+				"00:00:03.000 --> 00:00:04.500",
+				"Hi",
+			),
+			duration: 4.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track, err := ToVTT([]byte(tt.in), TSStartPTS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if track.VTT != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", track.VTT, tt.want)
+			}
+			if track.Duration != tt.duration {
+				t.Errorf("duration = %v, want %v", track.Duration, tt.duration)
+			}
+		})
+	}
+}
+
+func TestToVTTTimestampMap(t *testing.T) {
+	tests := []struct {
+		startPTS int64
+		want     string
+	}{
+		{TSStartPTS, "X-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000"},
+		{FMP4StartPTS, "X-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000"},
+	}
+
+	for _, tt := range tests {
+		track, err := ToVTT([]byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"), tt.startPTS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(track.VTT, "\n"); lines[1] != tt.want {
+			t.Errorf("start PTS %d: header %q, want %q", tt.startPTS, lines[1], tt.want)
+		}
+	}
+}
+
+func TestToVTTErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want error
+	}{
+		{"not subtitles", "hello world\n", ErrBadFormat},
+		{"vtt without cues", "WEBVTT\n\nNOTE nothing here\n", ErrEmpty},
+		{"srt without cues", "1\n\n", ErrEmpty},
+		{"latin-1", "1\n00:00:01,000 --> 00:00:02,000\ncaf\xe9\n", ErrNotUTF8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ToVTT([]byte(tt.in), TSStartPTS); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidLanguage(t *testing.T) {
+	for lang, want := range map[string]bool{
+		"en":      true,
+		"pt-BR":   true,
+		"zh-Hant": true,
+		"":        false,
+		"EN":      false,
+		"en/../x": false,
+		"e":       false,
+	} {
+		if got := ValidLanguage(lang); got != want {
+			t.Errorf("ValidLanguage(%q) = %v, want %v", lang, got, want)
+		}
+	}
+}
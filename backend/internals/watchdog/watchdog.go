@@ -0,0 +1,176 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/dispatch"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/jobs"
+	"log"
+	"time"
+)
+
+// returned from the update when the job moved on since it was checked
+var errNotStuck = errors.New("job is not stuck")
+
+// Config of the watchdog, zero values fall back to the defaults below
+type Config struct {
+	// a processing job without any update for this long is considered stuck
+	Timeout time.Duration
+	// a job still queued this long after it was queued is considered lost, e.g.
+	// when its task message is gone from the broker. Such jobs would otherwise
+	// count against the admission backlog forever
+	QueuedTimeout time.Duration
+	// how often the active jobs are checked
+	Interval time.Duration
+	// how often a stuck job is re-dispatched before it is failed, 0 disables retries
+	MaxRetries int
+}
+
+const (
+	defaultTimeout       = 30 * time.Minute
+	defaultQueuedTimeout = 6 * time.Hour
+	defaultInterval      = time.Minute
+)
+
+// Redispatch hands a queued job to the dispatcher again
+type Redispatch func(ctx context.Context, job *jobs.Job) (*jobs.Job, error)
+
+// Watchdog fails transcodes whose worker stopped reporting, e.g. because it died.
+// Every worker event refreshes the UpdatedAt of its job, so that is the heartbeat.
+type Watchdog struct {
+	jobs       *jobs.Store
+	bus        *events.Bus
+	dispatcher dispatch.Dispatcher
+	redispatch Redispatch
+	cfg        Config
+}
+
+func New(job_store *jobs.Store, bus *events.Bus, dispatcher dispatch.Dispatcher, redispatch Redispatch, cfg Config) *Watchdog {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.QueuedTimeout <= 0 {
+		cfg.QueuedTimeout = defaultQueuedTimeout
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	return &Watchdog{
+		jobs:       job_store,
+		bus:        bus,
+		dispatcher: dispatcher,
+		redispatch: redispatch,
+		cfg:        cfg,
+	}
+}
+
+// Run checks the active jobs every interval, it blocks until ctx is cancelled
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watchdog) check(ctx context.Context) {
+	ids, err := w.jobs.Active(ctx)
+	if err != nil {
+		log.Printf("watchdog: failed to list active jobs: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		job, err := w.jobs.Get(ctx, id)
+		if err != nil {
+			log.Printf("watchdog: failed to load job %s: %v", id, err)
+			continue
+		}
+		if _, ok := w.stuck(job); ok {
+			w.recover(ctx, job)
+		}
+	}
+}
+
+// reports why the job is stuck. Queued jobs may legitimately wait behind a long
+// backlog, so they get the much longer QueuedTimeout
+func (w *Watchdog) stuck(job *jobs.Job) (string, bool) {
+	switch job.Status {
+	case jobs.StatusProcessing:
+		if time.Since(job.UpdatedAt) > w.cfg.Timeout {
+			return fmt.Sprintf("no progress for %s, the worker is presumed dead", w.cfg.Timeout), true
+		}
+	case jobs.StatusQueued:
+		if job.QueuedAt != nil && time.Since(*job.QueuedAt) > w.cfg.QueuedTimeout {
+			return fmt.Sprintf("not picked up by a worker within %s", w.cfg.QueuedTimeout), true
+		}
+	}
+	return "", false
+}
+
+func (w *Watchdog) recover(ctx context.Context, job *jobs.Job) {
+	var reason string
+
+	// the worker may only be hung, make sure it does not come back later.
+	// A queued task is taken off its queue as well
+	if job.TaskID != "" {
+		if err := w.dispatcher.Revoke(ctx, job.TaskID, true); err != nil {
+			log.Printf("watchdog: failed to revoke task %s of job %s: %v", job.TaskID, job.ID, err)
+		}
+	}
+
+	retry := false
+	updated, err := w.jobs.Update(ctx, job.ID, func(j *jobs.Job) error {
+		// checked again inside the update, an event may have arrived meanwhile
+		var ok bool
+		if reason, ok = w.stuck(j); !ok {
+			return errNotStuck
+		}
+		if err := j.Transition(jobs.StatusFailed, reason); err != nil {
+			return err
+		}
+		retry = j.Retries < w.cfg.MaxRetries
+		if !retry {
+			return nil
+		}
+		retries := j.Retries
+		if err := j.Transition(jobs.StatusQueued, ""); err != nil {
+			return err
+		}
+		j.Retries = retries + 1
+		return nil
+	})
+	if errors.Is(err, errNotStuck) {
+		return
+	}
+	if err != nil {
+		log.Printf("watchdog: failed to update stuck job %s: %v", job.ID, err)
+		return
+	}
+
+	if !retry {
+		log.Printf("watchdog: failing job %s: %s", job.ID, reason)
+		ev := events.NewStatusEvent(job.ID, string(jobs.StatusFailed), reason)
+		ev.Error.Code = "timeout"
+		if job.Status == jobs.StatusQueued {
+			ev.Error.Code = "queue_timeout"
+		}
+		if err := w.bus.Publish(ctx, ev); err != nil {
+			log.Printf("watchdog: failed to publish failed event for job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("watchdog: re-dispatching stuck job %s (retry %d of %d): %s", job.ID, updated.Retries, w.cfg.MaxRetries, reason)
+	if _, err := w.redispatch(ctx, updated); err != nil {
+		log.Printf("watchdog: failed to re-dispatch job %s: %v", job.ID, err)
+	}
+}
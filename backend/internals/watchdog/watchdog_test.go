@@ -0,0 +1,38 @@
+package watchdog
+
+import (
+	"keyflicks_app/internals/jobs"
+	"testing"
+	"time"
+)
+
+func TestStuck(t *testing.T) {
+	w := New(nil, nil, nil, nil, Config{Timeout: 10 * time.Minute, QueuedTimeout: time.Hour})
+	ago := func(d time.Duration) *time.Time {
+		at := time.Now().UTC().Add(-d)
+		return &at
+	}
+
+	tests := []struct {
+		name string
+		job  jobs.Job
+		want bool
+	}{
+		{"processing with recent progress", jobs.Job{Status: jobs.StatusProcessing, UpdatedAt: *ago(time.Minute)}, false},
+		{"processing without progress", jobs.Job{Status: jobs.StatusProcessing, UpdatedAt: *ago(11 * time.Minute)}, true},
+		{"queued behind a backlog", jobs.Job{Status: jobs.StatusQueued, QueuedAt: ago(30 * time.Minute), UpdatedAt: *ago(30 * time.Minute)}, false},
+		{"queued too long", jobs.Job{Status: jobs.StatusQueued, QueuedAt: ago(2 * time.Hour), UpdatedAt: *ago(2 * time.Hour)}, true},
+		{"awaiting upload", jobs.Job{Status: jobs.StatusAwaitingUpload, UpdatedAt: *ago(24 * time.Hour)}, false},
+		{"failed", jobs.Job{Status: jobs.StatusFailed, UpdatedAt: *ago(24 * time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		reason, got := w.stuck(&tt.job)
+		if got != tt.want {
+			t.Errorf("%s: stuck = %v, want %v", tt.name, got, tt.want)
+		}
+		if got && reason == "" {
+			t.Errorf("%s: stuck without a reason", tt.name)
+		}
+	}
+}
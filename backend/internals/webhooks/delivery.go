@@ -0,0 +1,408 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/cache"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/jobs"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// attempts kept in the delivery log of a job
+	deliveryLogLength = 100
+	// seconds the delivery log, the queued deliveries and the sent markers are kept
+	deliveryLogTTL = 7 * 24 * 60 * 60
+	// sorted set of the ids of queued deliveries, scored by the unix milliseconds they are due at
+	queueKey = "webhook_queue"
+	// deliveries sent by one pass over the queue
+	drainBatch = 50
+)
+
+// Payload is the JSON body POSTed to the callback
+type Payload struct {
+	Event      string    `json:"event"` // job.ready or job.failed
+	DeliveryID string    `json:"delivery_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Job        JobInfo   `json:"job"`
+}
+
+// JobInfo is what a callback learns about the job, the storage keys, the task,
+// the uploader and the callback url stay internal
+type JobInfo struct {
+	ID     string      `json:"id"`
+	Status jobs.Status `json:"status"`
+	// version of the renditions served and of the ones the job produced
+	Version        int        `json:"version"`
+	PendingVersion int        `json:"pending_version"`
+	Profile        string     `json:"profile,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+func jobInfo(job *jobs.Job) JobInfo {
+	return JobInfo{
+		ID:             job.ID,
+		Status:         job.Status,
+		Version:        job.Version,
+		PendingVersion: job.PendingVersion,
+		Profile:        job.Profile,
+		Error:          job.Error,
+		CreatedAt:      job.CreatedAt,
+		FinishedAt:     job.FinishedAt,
+	}
+}
+
+// Delivery is one attempt in the delivery log of a job
+type Delivery struct {
+	DeliveryID string    `json:"delivery_id"`
+	Event      string    `json:"event"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Delivered  bool      `json:"delivered"`
+	At         time.Time `json:"at"`
+	// when the delivery is tried again, nil once it was delivered or given up
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+type target struct {
+	url    string
+	secret string
+}
+
+// pending is a queued delivery, it is kept until it was accepted or given up
+type pending struct {
+	ID     string          `json:"id"`
+	JobID  string          `json:"job_id"`
+	Event  string          `json:"event"`
+	URL    string          `json:"url"`
+	Secret string          `json:"secret"`
+	Body   json.RawMessage `json:"body"`
+	// attempts made so far
+	Attempt int       `json:"attempt"`
+	Due     time.Time `json:"due"`
+}
+
+func deliveryLogKey(jobID string) string {
+	return fmt.Sprintf("webhook_deliveries:%s", jobID)
+}
+
+func deliveryKey(id string) string {
+	return fmt.Sprintf("webhook_delivery:%s", id)
+}
+
+func leaseKey(id string) string {
+	return fmt.Sprintf("webhook_lease:%s", id)
+}
+
+// marks the result of a transcode as notified. A result is reported by several
+// events when the handlers or the watchdog and the worker both publish it, so
+// the job state and version are claimed rather than an event
+func sentKey(job *jobs.Job, status string) string {
+	return fmt.Sprintf("webhook_sent:%s:%s:v%d", job.ID, status, job.PendingVersion)
+}
+
+func score(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// Notify is registered as a jobs.Observer and queues the webhooks of finished jobs, see Run
+func (n *Notifier) Notify(ctx context.Context, job *jobs.Job, ev *events.Event) {
+	if ev.Type != events.TypeStatus {
+		return
+	}
+	if ev.Status != string(jobs.StatusReady) && ev.Status != string(jobs.StatusFailed) {
+		return
+	}
+
+	targets := n.targets(ctx, job)
+	if len(targets) == 0 {
+		return
+	}
+
+	// every API instance sees the event, only the first one to claim it queues the deliveries
+	claimed, err := n.redis.SetNX(ctx, sentKey(job, ev.Status), 1, deliveryLogTTL)
+	if err != nil {
+		log.Printf("webhooks: failed to claim delivery for job %s: %v", job.ID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	payload := Payload{
+		Event:     "job." + ev.Status,
+		Timestamp: time.Now().UTC(),
+		Job:       jobInfo(job),
+	}
+	for _, t := range targets {
+		p := payload
+		p.DeliveryID = uuid.New().String()
+		if err := n.enqueue(ctx, t, &p); err != nil {
+			log.Printf("webhooks: failed to queue %s for job %s to %s: %v", p.Event, job.ID, t.url, err)
+		}
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// the per upload callback and the callback registered for the uploader's API key,
+// every payload is signed
+func (n *Notifier) targets(ctx context.Context, job *jobs.Job) []target {
+	var targets []target
+
+	if job.Uploader != "" {
+		reg, err := n.Registration(ctx, job.Uploader)
+		if err == nil {
+			targets = append(targets, target{url: reg.URL, secret: reg.Secret})
+		} else if !errors.Is(err, ErrNotRegistered) {
+			log.Printf("webhooks: failed to load registration of %s: %v", job.Uploader, err)
+		}
+	}
+
+	if job.CallbackURL != "" && (len(targets) == 0 || targets[0].url != job.CallbackURL) {
+		secret, _, err := n.CallbackSecret(ctx, job.Uploader, job.ID)
+		if err != nil {
+			log.Printf("webhooks: not calling back %s for job %s: %v", job.CallbackURL, job.ID, err)
+			return targets
+		}
+		targets = append(targets, target{url: job.CallbackURL, secret: secret})
+	}
+	return targets
+}
+
+func (n *Notifier) enqueue(ctx context.Context, t target, payload *Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	d := &pending{
+		ID:     payload.DeliveryID,
+		JobID:  payload.Job.ID,
+		Event:  payload.Event,
+		URL:    t.url,
+		Secret: t.secret,
+		Body:   body,
+		Due:    time.Now().UTC(),
+	}
+	return n.schedule(ctx, d)
+}
+
+// stores the delivery before it is put in the queue, so the queue never names a missing one
+func (n *Notifier) schedule(ctx context.Context, d *pending) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := n.redis.Set(ctx, deliveryKey(d.ID), string(b), deliveryLogTTL); err != nil {
+		return err
+	}
+	return n.redis.ZAdd(ctx, queueKey, score(d.Due), d.ID)
+}
+
+// Run sends the queued deliveries until ctx is cancelled. The deliveries are
+// kept in redis until they were accepted or given up, so they survive restarts
+// and any instance running Run picks them up. An instance dying mid attempt
+// leaves its delivery to be sent again, callbacks are delivered at least once
+// and receivers should drop the delivery ids they have seen.
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		n.drain(ctx)
+		select {
+		case <-ticker.C:
+		case <-n.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sends the deliveries that are due
+func (n *Notifier) drain(ctx context.Context) {
+	ids, err := n.redis.ZRangeByScore(ctx, queueKey, score(time.Now()), drainBatch)
+	if err != nil {
+		log.Printf("webhooks: failed to read the delivery queue: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			n.send(ctx, id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// makes the next attempt of a delivery, holding a lease on it so that
+// instances draining the queue at the same time don't send it twice
+func (n *Notifier) send(ctx context.Context, id string) {
+	// outlives any attempt, the lease of a crashed instance runs out on its own
+	lease := int(2*n.cfg.Timeout/time.Second) + 1
+	claimed, err := n.redis.SetNX(ctx, leaseKey(id), 1, lease)
+	if err != nil {
+		log.Printf("webhooks: failed to lease delivery %s: %v", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	defer n.redis.Del(ctx, leaseKey(id))
+
+	data, err := n.redis.Get(ctx, deliveryKey(id))
+	if errors.Is(err, cache.ErrNil) {
+		// finished by another instance since the queue was read, or expired
+		_ = n.redis.ZRem(ctx, queueKey, id)
+		return
+	}
+	if err != nil {
+		log.Printf("webhooks: failed to load delivery %s: %v", id, err)
+		return
+	}
+	var d pending
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		log.Printf("webhooks: dropping malformed delivery %s: %v", id, err)
+		_ = n.redis.ZRem(ctx, queueKey, id)
+		return
+	}
+	if time.Now().Before(d.Due) {
+		// rescheduled by another instance since the queue was read
+		return
+	}
+
+	d.Attempt++
+	attempt := n.attempt(ctx, &d)
+
+	done := true
+	switch {
+	case attempt.Delivered:
+	case !retryable(attempt.StatusCode):
+		log.Printf("webhooks: %s for job %s rejected by %s with %d, giving up", d.Event, d.JobID, d.URL, attempt.StatusCode)
+	case d.Attempt >= n.cfg.MaxAttempts:
+		log.Printf("webhooks: %s for job %s not delivered to %s after %d attempts", d.Event, d.JobID, d.URL, d.Attempt)
+	default:
+		done = false
+		d.Due = time.Now().UTC().Add(n.backoff(d.Attempt))
+		attempt.NextAttemptAt = &d.Due
+		if err := n.schedule(ctx, &d); err != nil {
+			log.Printf("webhooks: failed to reschedule delivery %s: %v", id, err)
+		}
+	}
+	n.record(d.JobID, attempt)
+
+	if done {
+		_ = n.redis.ZRem(ctx, queueKey, id)
+		_ = n.redis.Del(ctx, deliveryKey(id))
+	}
+}
+
+// wait after the given failed attempt, doubled every time up to MaxBackoff
+func (n *Notifier) backoff(attempt int) time.Duration {
+	backoff := n.cfg.InitialBackoff
+	for i := 1; i < attempt && backoff < n.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, n.cfg.MaxBackoff)
+}
+
+func (n *Notifier) attempt(ctx context.Context, p *pending) *Delivery {
+	d := &Delivery{
+		DeliveryID: p.ID,
+		Event:      p.Event,
+		URL:        p.URL,
+		Attempt:    p.Attempt,
+		At:         time.Now().UTC(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(p.Body))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, p.Event)
+	req.Header.Set(DeliveryHeader, p.ID)
+	req.Header.Set(SignatureHeader, Sign(p.Secret, d.At, p.Body))
+
+	resp, err := n.client.Do(req)
+	d.DurationMs = time.Since(d.At).Milliseconds()
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	resp.Body.Close()
+
+	d.StatusCode = resp.StatusCode
+	d.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	return d
+}
+
+// network errors, timeouts, rate limits and server errors are retried
+func retryable(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// Sign returns the signature header value for a body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (n *Notifier) record(jobID string, d *Delivery) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.redis.LPushCapped(ctx, deliveryLogKey(jobID), deliveryLogLength, deliveryLogTTL, string(b)); err != nil {
+		log.Printf("webhooks: failed to log delivery for job %s: %v", jobID, err)
+	}
+}
+
+// Deliveries returns the logged attempts of a job, newest first
+func (n *Notifier) Deliveries(ctx context.Context, jobID string) ([]Delivery, error) {
+	entries, err := n.redis.LRange(ctx, deliveryLogKey(jobID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(entries))
+	for _, entry := range entries {
+		var d Delivery
+		if err := json.Unmarshal([]byte(entry), &d); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,464 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"keyflicks_app/internals/cache/cachetest"
+	"keyflicks_app/internals/events"
+	"keyflicks_app/internals/jobs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// receiver answers the given statuses in turn, 200 once they run out
+func newReceiver(t *testing.T, statuses ...int) (*httptest.Server, func() []receivedRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []receivedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		status := http.StatusOK
+		if len(received) < len(statuses) {
+			status = statuses[len(received)]
+		}
+		received = append(received, receivedRequest{header: r.Header.Clone(), body: body, at: time.Now()})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []receivedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedRequest(nil), received...)
+	}
+}
+
+func newTestNotifier(t *testing.T, rds Redis, cfg Config) *Notifier {
+	t.Helper()
+	if cfg.AllowedHosts == nil {
+		// httptest listens on loopback
+		cfg.AllowedHosts = []string{"127.0.0.1"}
+	}
+	if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = 10 * time.Millisecond
+	}
+	return NewNotifier(rds, cfg)
+}
+
+func testPayload(jobID string) *Payload {
+	return &Payload{
+		Event:      "job.ready",
+		DeliveryID: "delivery-1",
+		Timestamp:  time.Now().UTC(),
+		Job:        JobInfo{ID: jobID, Status: jobs.StatusReady},
+	}
+}
+
+// drains the queue until every delivery was delivered or given up
+func drainAll(t *testing.T, rds Redis, notifiers ...*Notifier) {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var wg sync.WaitGroup
+		for _, n := range notifiers {
+			wg.Add(1)
+			go func(n *Notifier) {
+				defer wg.Done()
+				n.drain(ctx)
+			}(n)
+		}
+		wg.Wait()
+
+		queued, err := rds.ZRangeByScore(ctx, queueKey, score(time.Now().Add(time.Hour)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queued) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries %v still queued", queued)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func deliver(t *testing.T, rds Redis, n *Notifier, tg target, payload *Payload) {
+	t.Helper()
+	if err := n.enqueue(context.Background(), tg, payload); err != nil {
+		t.Fatal(err)
+	}
+	drainAll(t, rds, n)
+}
+
+var signatureRe = regexp.MustCompile(`^t=(\d+),v1=([0-9a-f]{64})$`)
+
+func verify(t *testing.T, secret string, header string, body []byte) {
+	t.Helper()
+	m := signatureRe.FindStringSubmatch(header)
+	if m == nil {
+		t.Fatalf("signature header %q does not match t=<unix>,v1=<hex>", header)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(m[1] + "."))
+	mac.Write(body)
+	if !hmac.Equal([]byte(m[2]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Fatalf("signature %s does not verify", header)
+	}
+}
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	header := Sign("secret", at, []byte(`{"a":1}`))
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("unexpected header %q", header)
+	}
+	verify(t, "secret", header, []byte(`{"a":1}`))
+
+	if Sign("other", at, []byte(`{"a":1}`)) == header {
+		t.Fatal("signature does not depend on the secret")
+	}
+}
+
+func TestDeliverSignsAndRecords(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t)
+	n := newTestNotifier(t, rds, Config{})
+
+	payload := testPayload("job1")
+	deliver(t, rds, n, target{url: srv.URL, secret: "s3cret"}, payload)
+
+	reqs := received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	r := reqs[0]
+	verify(t, "s3cret", r.header.Get(SignatureHeader), r.body)
+	if got := r.header.Get(EventHeader); got != "job.ready" {
+		t.Errorf("event header = %q", got)
+	}
+	if got := r.header.Get(DeliveryHeader); got != payload.DeliveryID {
+		t.Errorf("delivery header = %q", got)
+	}
+
+	deliveries, err := n.Deliveries(context.Background(), "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d logged deliveries, want 1", len(deliveries))
+	}
+	d := deliveries[0]
+	if !d.Delivered || d.StatusCode != http.StatusOK || d.Attempt != 1 || d.URL != srv.URL || d.DeliveryID != payload.DeliveryID {
+		t.Errorf("unexpected delivery log entry %+v", d)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		attempts  int
+		delivered bool
+	}{
+		{"server errors are retried", []int{500, 503}, 3, true},
+		{"rate limits are retried", []int{429}, 2, true},
+		{"client errors stop", []int{400}, 1, false},
+		{"gone stops", []int{410}, 1, false},
+		{"gives up after max attempts", []int{500, 500, 500, 500}, 4, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rds := cachetest.NewMemory()
+			srv, received := newReceiver(t, tt.statuses...)
+			backoff := 20 * time.Millisecond
+			n := newTestNotifier(t, rds, Config{MaxAttempts: 4, InitialBackoff: backoff, MaxBackoff: time.Second})
+
+			deliver(t, rds, n, target{url: srv.URL, secret: "s"}, testPayload("job1"))
+
+			reqs := received()
+			if len(reqs) != tt.attempts {
+				t.Fatalf("got %d attempts, want %d", len(reqs), tt.attempts)
+			}
+			// the wait doubles after every failure
+			for i := 1; i < len(reqs); i++ {
+				want := backoff << (i - 1)
+				if gap := reqs[i].at.Sub(reqs[i-1].at); gap < want {
+					t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, gap, want)
+				}
+			}
+
+			deliveries, err := n.Deliveries(context.Background(), "job1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deliveries) != tt.attempts {
+				t.Fatalf("logged %d attempts, want %d", len(deliveries), tt.attempts)
+			}
+			// newest first
+			if last := deliveries[0]; last.Attempt != tt.attempts || last.Delivered != tt.delivered {
+				t.Errorf("last logged attempt %+v, want attempt %d delivered=%v", last, tt.attempts, tt.delivered)
+			}
+		})
+	}
+}
+
+func TestNotifyDeliversOnce(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t)
+	ctx := context.Background()
+
+	// two API instances, both apply every worker event to the shared job record
+	var notifiers []*Notifier
+	var stores []*jobs.Store
+	for i := 0; i < 2; i++ {
+		n := newTestNotifier(t, rds, Config{})
+		store := jobs.NewStore(rds)
+		store.Observe(n.Notify)
+		notifiers = append(notifiers, n)
+		stores = append(stores, store)
+	}
+	reg, err := notifiers[0].Register(ctx, "client1", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := jobs.NewJob("job1", "uploads/job1.mp4", "")
+	job.Uploader = "client1"
+	job.Status = jobs.StatusProcessing
+	if err := stores[0].Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := events.NewStatusEvent(job.ID, string(jobs.StatusReady), "")
+	ev.ID = "1700000000000-0"
+	stores[0].Handle(ctx, ev)
+	stores[1].Handle(ctx, ev)
+	// the same result published again, e.g. by a retried worker
+	again := events.NewStatusEvent(job.ID, string(jobs.StatusReady), "")
+	again.ID = "1700000000001-0"
+	stores[1].Handle(ctx, again)
+
+	drainAll(t, rds, notifiers...)
+
+	reqs := received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(reqs))
+	}
+	verify(t, reg.Secret, reqs[0].header.Get(SignatureHeader), reqs[0].body)
+}
+
+func TestNotifyAgainForNewVersion(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t)
+	ctx := context.Background()
+
+	n := newTestNotifier(t, rds, Config{})
+	store := jobs.NewStore(rds)
+	store.Observe(n.Notify)
+	if _, err := n.Register(ctx, "client1", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	job := jobs.NewJob("job1", "uploads/job1.mp4", "")
+	job.Uploader = "client1"
+	job.Status = jobs.StatusProcessing
+	if err := store.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	store.Handle(ctx, events.NewStatusEvent(job.ID, string(jobs.StatusReady), ""))
+
+	// a re-transcode finishing is a result of its own
+	if _, err := store.Update(ctx, job.ID, func(j *jobs.Job) error {
+		j.PendingVersion++
+		return j.Transition(jobs.StatusQueued, "")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.Handle(ctx, events.NewStatusEvent(job.ID, string(jobs.StatusReady), ""))
+	drainAll(t, rds, n)
+
+	if got := len(received()); got != 2 {
+		t.Fatalf("got %d deliveries, want one per version", got)
+	}
+}
+
+func TestPayloadKeepsInternalsOut(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t)
+	ctx := context.Background()
+	n := newTestNotifier(t, rds, Config{Secret: "deployment"})
+
+	finished := time.Now().UTC()
+	job := &jobs.Job{
+		ID:          "job1",
+		Status:      jobs.StatusReady,
+		S3Key:       "uploads/job1.mp4",
+		TaskID:      "task-1",
+		Uploader:    "client1",
+		CallbackURL: srv.URL,
+		Version:     1,
+		FinishedAt:  &finished,
+	}
+	n.Notify(ctx, job, events.NewStatusEvent(job.ID, string(jobs.StatusReady), ""))
+	drainAll(t, rds, n)
+
+	reqs := received()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(reqs))
+	}
+	var body struct {
+		Job map[string]interface{} `json:"job"`
+	}
+	if err := json.Unmarshal(reqs[0].body, &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"s3_key", "task_id", "uploader", "callback_url"} {
+		if _, ok := body.Job[field]; ok {
+			t.Errorf("payload carries %s: %s", field, reqs[0].body)
+		}
+	}
+	if body.Job["id"] != "job1" || body.Job["version"] != float64(1) {
+		t.Errorf("unexpected job in payload: %s", reqs[0].body)
+	}
+}
+
+func TestQueuedDeliverySurvivesRestart(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t, http.StatusServiceUnavailable)
+	ctx := context.Background()
+
+	n := newTestNotifier(t, rds, Config{InitialBackoff: 50 * time.Millisecond})
+	if err := n.enqueue(ctx, target{url: srv.URL, secret: "s"}, testPayload("job1")); err != nil {
+		t.Fatal(err)
+	}
+	n.drain(ctx)
+	if len(received()) != 1 {
+		t.Fatal("first attempt was not made")
+	}
+
+	// the instance is gone, another one picks the retry up from redis
+	other := newTestNotifier(t, rds, Config{InitialBackoff: 50 * time.Millisecond})
+	drainAll(t, rds, other)
+
+	reqs := received()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(reqs))
+	}
+	if reqs[0].header.Get(DeliveryHeader) != reqs[1].header.Get(DeliveryHeader) {
+		t.Error("the retry changed the delivery id")
+	}
+	deliveries, err := other.Deliveries(ctx, "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || !deliveries[0].Delivered || deliveries[1].NextAttemptAt == nil {
+		t.Fatalf("unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestCallbackSecret(t *testing.T) {
+	rds := cachetest.NewMemory()
+	ctx := context.Background()
+
+	unsigned := newTestNotifier(t, rds, Config{})
+	if _, _, err := unsigned.CallbackSecret(ctx, "", "job1"); err != ErrNoSecret {
+		t.Fatalf("got %v without any secret, want ErrNoSecret", err)
+	}
+
+	n := newTestNotifier(t, rds, Config{Secret: "deployment"})
+	s1, derived, err := n.CallbackSecret(ctx, "", "job1")
+	if err != nil || !derived {
+		t.Fatalf("got derived=%v err=%v, want a derived secret", derived, err)
+	}
+	s2, _, _ := n.CallbackSecret(ctx, "", "job2")
+	if s1 == s2 || s1 == "deployment" {
+		t.Fatal("uploads must not share their callback secret")
+	}
+
+	reg, err := n.Register(ctx, "client1", "http://127.0.0.1:1/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, derived, err := n.CallbackSecret(ctx, "client1", "job1")
+	if err != nil || derived || s != reg.Secret {
+		t.Fatalf("got %q derived=%v err=%v, want the registration secret", s, derived, err)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	n := NewNotifier(nil, Config{AllowedHosts: []string{"hooks.internal"}})
+	ctx := context.Background()
+
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://hooks.internal:8080/hook", true},
+		{"ftp://93.184.216.34/hook", false},
+		{"https:///hook", false},
+		{"http://127.0.0.1:6379/", false},
+		{"http://[::1]/", false},
+		{"http://10.1.2.3/", false},
+		{"http://192.168.0.10/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://0.0.0.0/", false},
+		{"http://localhost:9000/", false},
+	}
+	for _, tt := range tests {
+		err := n.ValidateURL(ctx, tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateURL(%q) = %v, want ok=%v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestDeliverRefusesInternalAddresses(t *testing.T) {
+	rds := cachetest.NewMemory()
+	srv, received := newReceiver(t)
+	n := newTestNotifier(t, rds, Config{MaxAttempts: 1, AllowedHosts: []string{}})
+
+	deliver(t, rds, n, target{url: srv.URL, secret: "s"}, testPayload("job1"))
+
+	if len(received()) != 0 {
+		t.Fatal("delivered to a loopback address")
+	}
+	deliveries, err := n.Deliveries(context.Background(), "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Delivered || !strings.Contains(deliveries[0].Error, "internal address") {
+		t.Fatalf("unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestRegisterUnknownClient(t *testing.T) {
+	rds := cachetest.NewMemory()
+	n := newTestNotifier(t, rds, Config{Clients: []string{"client1"}})
+
+	if _, err := n.Register(context.Background(), "client2", "http://127.0.0.1:1/hook"); err != ErrUnknownClient {
+		t.Fatalf("got %v, want ErrUnknownClient", err)
+	}
+	if _, err := n.Register(context.Background(), "client1", "http://127.0.0.1:1/hook"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,284 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keyflicks_app/internals/cache"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNotRegistered = errors.New("no webhook registered")
+	// returned by Register for API keys that are not allowed to register webhooks
+	ErrUnknownClient = errors.New("unknown API client")
+	// returned by CallbackSecret when a callback could not be signed
+	ErrNoSecret = errors.New("no secret to sign the callback with")
+)
+
+// InvalidURLError is returned by Register for callback urls ValidateURL refuses
+type InvalidURLError struct {
+	Err error
+}
+
+func (e *InvalidURLError) Error() string {
+	return "invalid url: " + e.Err.Error()
+}
+
+func (e *InvalidURLError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// header carrying "t=<unix seconds>,v1=<hex hmac-sha256 of "<t>.<body>">"
+	SignatureHeader = "X-Keyflicks-Signature"
+	EventHeader     = "X-Keyflicks-Event"
+	DeliveryHeader  = "X-Keyflicks-Delivery"
+)
+
+// Registration is the callback of one API client
+type Registration struct {
+	URL string `json:"url"`
+	// key the payloads are signed with, only shown when registering
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Config of the notifier, zero values fall back to the defaults
+type Config struct {
+	// callbacks of uploads whose client registered no webhook of its own are
+	// signed with a key derived from it and the upload id, see CallbackSecret.
+	// Without it such uploads can't ask for a callback.
+	Secret string
+	// client ids (auth.ClientID) allowed to register webhooks, empty allows every API key
+	Clients []string
+	// hosts callbacks may go to even though they are loopback, private or link-local addresses
+	AllowedHosts []string
+	// deliveries are given up after this many attempts
+	MaxAttempts int
+	// wait before the first retry, doubled after every failure up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// timeout of a single request
+	Timeout time.Duration
+	// how often Run looks for deliveries that are due
+	PollInterval time.Duration
+}
+
+// Redis is the part of cache.RedisDB the notifier keeps the registrations and the deliveries in
+type Redis interface {
+	Set(ctx context.Context, key string, value interface{}, exp_time int) error
+	Get(ctx context.Context, key string) (string, error)
+	Del(ctx context.Context, keys ...string) error
+	SetNX(ctx context.Context, key string, value interface{}, exp_time int) (bool, error)
+	LPushCapped(ctx context.Context, key string, maxLen int64, exp_time int, values ...interface{}) error
+	LRange(ctx context.Context, key string, start int64, stop int64) ([]string, error)
+	ZAdd(ctx context.Context, key string, score float64, member string) error
+	ZRangeByScore(ctx context.Context, key string, max float64, count int64) ([]string, error)
+	ZRem(ctx context.Context, key string, members ...interface{}) error
+}
+
+// Notifier POSTs job results to the callback URLs of the uploaders
+type Notifier struct {
+	redis   Redis
+	client  *http.Client
+	cfg     Config
+	clients map[string]bool
+	allowed map[string]bool
+	// pokes Run when Notify queued a delivery
+	wake chan struct{}
+}
+
+func NewNotifier(rds Redis, cfg Config) *Notifier {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 6
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 5 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	n := &Notifier{
+		redis:   rds,
+		cfg:     cfg,
+		clients: make(map[string]bool, len(cfg.Clients)),
+		allowed: make(map[string]bool, len(cfg.AllowedHosts)),
+		wake:    make(chan struct{}, 1),
+	}
+	for _, id := range cfg.Clients {
+		n.clients[id] = true
+	}
+	for _, host := range cfg.AllowedHosts {
+		n.allowed[strings.ToLower(host)] = true
+	}
+
+	// the address is checked again when connecting, a host may resolve
+	// to something else than when its url was validated
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	n.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				if n.allowed[strings.ToLower(host)] {
+					return dialer.DialContext(ctx, network, addr)
+				}
+				checked := *dialer
+				checked.Control = func(network string, address string, _ syscall.RawConn) error {
+					ip, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if internalIP(net.ParseIP(ip)) {
+						return fmt.Errorf("%s is an internal address", ip)
+					}
+					return nil
+				}
+				return checked.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	return n
+}
+
+func registrationKey(clientID string) string {
+	return fmt.Sprintf("webhook:%s", clientID)
+}
+
+// loopback, private, link-local and multicast addresses, callbacks must not reach
+// the services next to the API (redis, minio, the metadata endpoint of the cloud..)
+func internalIP(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// ValidateURL accepts absolute http(s) URLs of public hosts, and of the AllowedHosts
+func (n *Notifier) ValidateURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if n.allowed[strings.ToLower(host)] {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if internalIP(ip) {
+			return fmt.Errorf("%s is an internal address", host)
+		}
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return fmt.Errorf("%s resolves to an internal address", host)
+		}
+	}
+	return nil
+}
+
+// Register sets the callback URL of a client and issues a fresh signing secret
+func (n *Notifier) Register(ctx context.Context, clientID string, callbackURL string) (*Registration, error) {
+	if len(n.clients) > 0 && !n.clients[clientID] {
+		return nil, ErrUnknownClient
+	}
+	if err := n.ValidateURL(ctx, callbackURL); err != nil {
+		return nil, &InvalidURLError{Err: err}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	reg := &Registration{
+		URL:       callbackURL,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	b, err := json.Marshal(reg)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.redis.Set(ctx, registrationKey(clientID), string(b), 0); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Registration returns the webhook of a client including its secret
+func (n *Notifier) Registration(ctx context.Context, clientID string) (*Registration, error) {
+	data, err := n.redis.Get(ctx, registrationKey(clientID))
+	if errors.Is(err, cache.ErrNil) {
+		return nil, ErrNotRegistered
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reg Registration
+	if err := json.Unmarshal([]byte(data), &reg); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+// CallbackSecret returns the key the callback of an upload is signed with: the
+// secret of the uploader's webhook, or one derived from Config.Secret for this
+// upload alone, so receivers can't forge the callbacks of other uploads.
+// derived reports the latter, the uploader learns it only from the upload response.
+func (n *Notifier) CallbackSecret(ctx context.Context, clientID string, jobID string) (secret string, derived bool, err error) {
+	if clientID != "" {
+		reg, err := n.Registration(ctx, clientID)
+		if err == nil {
+			return reg.Secret, false, nil
+		}
+		if !errors.Is(err, ErrNotRegistered) {
+			return "", false, err
+		}
+	}
+	if n.cfg.Secret == "" {
+		return "", false, ErrNoSecret
+	}
+	mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+	mac.Write([]byte("callback:" + jobID))
+	return hex.EncodeToString(mac.Sum(nil)), true, nil
+}
+
+func (n *Notifier) Unregister(ctx context.Context, clientID string) error {
+	return n.redis.Del(ctx, registrationKey(clientID))
+}
@@ -15,5 +15,10 @@ celery.conf.update(
     result_serializer='json',
     enable_utc=True,
     task_protocol=1,   # important for gocelery compatibility
+    task_track_started=True,  # GET /api/jobs/:id reports STARTED instead of PENDING
 )
 
+# the api routes jobs to several queues (see backend/internals/celery/routing.go).
+# Start a pool per queue, or one pool for all of them:
+#   celery -A app.celery_app worker -Q video_tasks_high,video_tasks,video_tasks_bulk
+celery.conf.task_default_queue = 'video_tasks'
@@ -0,0 +1,81 @@
+import os
+from xml.sax.saxutils import quoteattr
+
+# must match dash.ManifestFile / InitSegment / MediaTemplate on the Go side
+MANIFEST_FILE = "manifest.mpd"
+INIT_SEGMENT = "init.mp4"
+MEDIA_TEMPLATE = "seg_$Number%03d$.m4s"
+
+# durations of the timelines are in milliseconds
+TIMESCALE = 1000
+
+# codec strings announced per profile codec, the highest level the ladders use
+CODECS = {
+    "h264": "avc1.640028,mp4a.40.2",
+    "hevc": "hvc1.1.6.L120.90,mp4a.40.2",
+    "av1": "av01.0.08M.08,mp4a.40.2",
+}
+
+
+def segment_durations(playlist_path):
+    """EXTINF durations of an fMP4 HLS media playlist written by ffmpeg."""
+    durations, has_init = [], False
+    with open(playlist_path) as f:
+        for line in f:
+            line = line.strip()
+            if line.startswith("#EXT-X-MAP:") and f'URI="{INIT_SEGMENT}"' in line:
+                has_init = True
+            elif line.startswith("#EXTINF:"):
+                durations.append(float(line[len("#EXTINF:"):].split(",")[0]))
+    if not has_init:
+        raise ValueError(f"{playlist_path} is not made of fMP4 segments")
+    return durations
+
+
+def timeline(durations):
+    runs = []
+    for seconds in durations:
+        d = round(seconds * TIMESCALE)
+        if runs and runs[-1][0] == d:
+            runs[-1][1] += 1
+        else:
+            runs.append([d, 0])
+    return "".join(f'<S d="{d}" r="{r}"/>' if r else f'<S d="{d}"/>' for d, r in runs)
+
+
+def write_manifest(profile, variants, out_dirs, out_path):
+    """
+    Writes a static DASH manifest that addresses the CMAF segments of the HLS
+    renditions, the same layout dash.Build writes on the Go side.
+    """
+    codecs = CODECS.get(profile.get("codec"), CODECS["h264"])
+    representations, duration = [], 0.0
+    for variant, out_dir in zip(variants, out_dirs):
+        durations = segment_durations(os.path.join(out_dir, "playlist.m3u8"))
+        duration = max(duration, sum(durations))
+        name = variant["name"]
+        representations.append(
+            f'      <Representation id={quoteattr(name)} bandwidth="{variant["video_bitrate"] + variant["audio_bitrate"]}"'
+            f' width="{variant["width"]}" height="{variant["height"]}" codecs="{codecs}">\n'
+            f'        <BaseURL>{name}/</BaseURL>\n'
+            f'        <SegmentTemplate timescale="{TIMESCALE}" initialization="{INIT_SEGMENT}" media="{MEDIA_TEMPLATE}" startNumber="0">\n'
+            f'          <SegmentTimeline>{timeline(durations)}</SegmentTimeline>\n'
+            f'        </SegmentTemplate>\n'
+            f'      </Representation>'
+        )
+
+    manifest = "\n".join([
+        '<?xml version="1.0" encoding="UTF-8"?>',
+        '<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011"'
+        f' type="static" mediaPresentationDuration="PT{duration:.3f}S" minBufferTime="PT2S">',
+        '  <Period id="0" start="PT0S">',
+        '    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true">',
+        *representations,
+        '    </AdaptationSet>',
+        '  </Period>',
+        '</MPD>',
+        '',
+    ])
+    with open(out_path, "w") as f:
+        f.write(manifest)
+    return out_path
@@ -0,0 +1,116 @@
+import json
+import threading
+import time
+from datetime import datetime, timezone
+
+# must match events.SchemaVersion on the Go side
+SCHEMA_VERSION = 1
+
+# minimum number of seconds between two progress events
+PROGRESS_INTERVAL = 1.0
+
+# must match historyLength / historyTTL in events/bus.go
+HISTORY_LENGTH = 200
+HISTORY_TTL = 24 * 60 * 60
+
+
+class JobEvents:
+    """
+    Publishes versioned status/progress events for one job on job_status_<id>.
+    Rendition progress is reported from several ffmpeg threads, so all state
+    is guarded by a lock.
+    """
+
+    def __init__(self, redis_client, upload_id, renditions):
+        self.redis = redis_client
+        self.upload_id = upload_id
+        self.channel = f"job_status_{upload_id}"
+        self.history_key = f"job_events:{upload_id}"
+        self.lock = threading.Lock()
+        self.seq = 0
+        self.stage = "queued"
+        self.started = time.monotonic()
+        self.last_progress = 0.0
+        self.renditions = {r: {"state": "pending", "percent": 0.0} for r in renditions}
+
+    def _publish(self, event):
+        # same layout as events.Bus.Publish: record in the job history first,
+        # then broadcast with the stream entry ID so clients can resume
+        self.seq += 1
+        event.update({
+            "v": SCHEMA_VERSION,
+            "seq": self.seq,
+            "job_id": self.upload_id,
+            "ts": datetime.now(timezone.utc).isoformat(),
+        })
+        entry_id = self.redis.xadd(self.history_key, {"event": json.dumps(event)},
+                                   maxlen=HISTORY_LENGTH, approximate=True)
+        self.redis.expire(self.history_key, HISTORY_TTL)
+        if isinstance(entry_id, bytes):
+            entry_id = entry_id.decode()
+        event["id"] = entry_id
+        self.redis.publish(self.channel, json.dumps(event))
+
+    def _overall_percent(self):
+        if not self.renditions:
+            return 0.0
+        return sum(r["percent"] for r in self.renditions.values()) / len(self.renditions)
+
+    def status(self, status, error=None, code=None):
+        with self.lock:
+            if status == "ready":
+                self.stage = "done"
+            event = {"type": "status", "status": status, "stage": self.stage}
+            if status == "ready":
+                event["percent"] = 100.0
+            if error is not None:
+                event["error"] = {"message": str(error) or "transcoding failed"}
+                if code:
+                    event["error"]["code"] = code
+            self._publish(event)
+
+    def set_stage(self, stage):
+        with self.lock:
+            self.stage = stage
+        self.progress(force=True)
+
+    def rendition(self, name, state=None, percent=None):
+        with self.lock:
+            r = self.renditions.setdefault(name, {"state": "pending", "percent": 0.0})
+            if state is not None:
+                r["state"] = state
+            if percent is not None:
+                r["percent"] = max(0.0, min(100.0, round(percent, 1)))
+            if state == "done":
+                r["percent"] = 100.0
+        self.progress(rendition=name, force=state is not None)
+
+    def progress(self, rendition=None, force=False):
+        with self.lock:
+            now = time.monotonic()
+            if not force and now - self.last_progress < PROGRESS_INTERVAL:
+                return
+            self.last_progress = now
+
+            percent = round(self._overall_percent(), 1)
+            event = {
+                "type": "progress",
+                "status": "processing",
+                "stage": self.stage,
+                "percent": percent,
+                "renditions": {k: dict(v) for k, v in self.renditions.items()},
+            }
+            if rendition:
+                event["rendition"] = rendition
+            if 0 < percent < 100:
+                elapsed = now - self.started
+                event["eta_seconds"] = round(elapsed * (100 - percent) / percent, 1)
+            self._publish(event)
+
+    def track(self, kind, language, state, error=None):
+        """Reports the state of an extra track (e.g. an audio language), the job state is left alone."""
+        with self.lock:
+            event = {"type": "track", "track": {"kind": kind, "language": language, "state": state}}
+            if state == "failed":
+                event["error"] = {"message": str(error or "") or "packaging failed"}
+            self._publish(event)
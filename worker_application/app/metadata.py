@@ -0,0 +1,87 @@
+import json
+import os
+import subprocess
+
+# written next to master.m3u8, must match jobs.MetadataFile on the Go side
+METADATA_FILE = "metadata.json"
+
+
+def _frame_rate(rational):
+    """Parses ffprobe's rational rates like "30000/1001"."""
+    num, _, den = (rational or "").partition("/")
+    try:
+        n, d = float(num), float(den or 1)
+    except ValueError:
+        return 0.0
+    return round(n / d, 3) if d else 0.0
+
+
+def extract(url):
+    """
+    Container, duration and the first video and audio stream of url,
+    in the layout of probe.Metadata on the Go side.
+    """
+    out = subprocess.run(
+        ["ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", url],
+        capture_output=True, text=True, check=True,
+    ).stdout
+    parsed = json.loads(out)
+    fmt = parsed.get("format", {})
+
+    md = {
+        "container": fmt.get("format_name", "").split(",")[0],
+        "duration": float(fmt.get("duration") or 0),
+        "size_bytes": int(fmt.get("size") or 0),
+    }
+    if fmt.get("bit_rate"):
+        md["bitrate"] = int(fmt["bit_rate"])
+
+    for s in parsed.get("streams", []):
+        if s.get("codec_type") == "video" and "video" not in md:
+            width, height = s.get("width", 0), s.get("height", 0)
+            rotation = float((s.get("tags") or {}).get("rotate") or 0)
+            for sd in s.get("side_data_list", []):
+                rotation = sd.get("rotation") or rotation
+            if int(rotation) % 180:
+                width, height = height, width
+            md["video"] = {
+                "codec": s.get("codec_name", ""),
+                "width": width,
+                "height": height,
+                "frame_rate": _frame_rate(s.get("avg_frame_rate")) or _frame_rate(s.get("r_frame_rate")),
+            }
+        elif s.get("codec_type") == "audio" and "audio" not in md:
+            md["audio"] = {
+                "codec": s.get("codec_name", ""),
+                "channels": s.get("channels", 0),
+                "sample_rate": int(s.get("sample_rate") or 0),
+            }
+    return md
+
+
+def write_metadata(url, size_bytes, rendition_dirs, out_path, warnings=None):
+    """
+    Describes the original and every rendition (name -> local HLS folder) in out_path,
+    along with the warnings (output -> reason) about the extras that could not be made.
+    ffprobe only sees a rendition's playlist, so its size is the sum of its files.
+    """
+    original = extract(url)
+    if not original["size_bytes"]:
+        original["size_bytes"] = size_bytes or 0
+
+    renditions = {}
+    for name, local_dir in rendition_dirs.items():
+        md = extract(os.path.join(local_dir, "playlist.m3u8"))
+        md["size_bytes"] = sum(
+            os.path.getsize(os.path.join(local_dir, f)) for f in os.listdir(local_dir)
+        )
+        if md["duration"]:
+            md["bitrate"] = int(md["size_bytes"] * 8 / md["duration"])
+        renditions[name] = md
+
+    md = {"original": original, "renditions": renditions}
+    if warnings:
+        md["warnings"] = warnings
+    with open(out_path, "w") as f:
+        json.dump(md, f)
+    return out_path
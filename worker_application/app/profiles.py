@@ -0,0 +1,51 @@
+# Encoding profiles are defined on the Go side (internals/profiles) and sent
+# in full with every task. This fallback only covers messages queued by older
+# API versions that passed just a profile name.
+DEFAULT_PROFILE = {
+    "name": "default",
+    "codec": "h264",
+    "segment_duration": 6,
+    "renditions": [
+        {"name": "360p", "width": 640, "height": 360, "video_bitrate": 672000, "audio_bitrate": 128000},
+        {"name": "480p", "width": 854, "height": 480, "video_bitrate": 1272000, "audio_bitrate": 128000},
+        {"name": "720p", "width": 1280, "height": 720, "video_bitrate": 2672000, "audio_bitrate": 128000},
+        {"name": "1080p", "width": 1920, "height": 1080, "video_bitrate": 4872000, "audio_bitrate": 128000},
+    ],
+}
+
+# GPU encoders used for the profile codecs
+ENCODERS = {
+    "h264": "h264_nvenc",
+    "hevc": "hevc_nvenc",
+    "av1": "av1_nvenc",
+}
+
+
+def hls_version(profile):
+    """EXT-X-VERSION the playlists need, see Profile.HLSVersion on the Go side."""
+    if profile.get("container") == "fmp4":
+        return 7
+    if profile.get("single_file"):
+        return 4
+    return 3
+
+
+def hls_segment_args(profile, out_dir):
+    """Segment container and naming of ffmpeg's HLS muxer, same layout as the Go runner."""
+    args = []
+    ext = ".ts"
+    if profile.get("container") == "fmp4":
+        ext = ".m4s"
+        args += ["-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "init.mp4"]
+        if profile.get("codec") == "hevc":
+            # Apple players only accept HEVC tagged as hvc1
+            args += ["-tag:v", "hvc1"]
+    if profile.get("single_file"):
+        return args + ["-hls_flags", "single_file", "-hls_segment_filename", f"{out_dir}/stream{ext}"]
+    return args + ["-hls_segment_filename", f"{out_dir}/seg_%03d{ext}"]
+
+
+def resolve_profile(profile):
+    if isinstance(profile, dict) and profile.get("renditions"):
+        return profile
+    return DEFAULT_PROFILE
@@ -1,7 +1,13 @@
 import subprocess
+import mimetypes
 from mimetypes import guess_type
 from concurrent.futures import ThreadPoolExecutor
 from app.s3_configuration import s3, STREAMING_BUCKET, PENDING_BUCKET
+from app.dash import MANIFEST_FILE, write_manifest
+from app.events import JobEvents
+from app.metadata import METADATA_FILE, write_metadata
+from app.profiles import ENCODERS, hls_segment_args, hls_version, resolve_profile
+from app.thumbnails import THUMBS_DIR, generate_sprites, generate_stills
 from celery import shared_task
 import os
 import tempfile
@@ -10,17 +16,80 @@ import redis
 
 redis_client_sync = redis.Redis(host='localhost', port=6379, db=0)
 
+# fMP4 (CMAF) media segments, unknown to most mime tables
+mimetypes.add_type("video/iso.segment", ".m4s")
+
+
+def probe_duration(url):
+    """Returns the duration of the input in seconds, or None if ffprobe can't tell."""
+    try:
+        out = subprocess.run(
+            ["ffprobe", "-v", "error", "-show_entries", "format=duration",
+             "-of", "default=noprint_wrappers=1:nokey=1", url],
+            capture_output=True, text=True, check=True,
+        ).stdout.strip()
+        return float(out)
+    except (subprocess.CalledProcessError, ValueError):
+        return None
+
+
+def run_ffmpeg(cmd, duration, on_progress):
+    """
+    Runs ffmpeg with machine readable progress on stdout and calls
+    on_progress(percent) as the encode advances.
+    """
+    cmd = cmd[:1] + ["-nostats", "-progress", "pipe:1"] + cmd[1:]
+    proc = subprocess.Popen(cmd, stdout=subprocess.PIPE, text=True)
+    for line in proc.stdout:
+        key, _, value = line.strip().partition("=")
+        if key != "out_time_us":
+            continue
+        if duration and value.isdigit():
+            on_progress(int(value) / 1_000_000 / duration * 100)
+        else:
+            # without a duration there is no percent, but the api's watchdog still needs a sign of life
+            on_progress(None)
+    if proc.wait() != 0:
+        raise subprocess.CalledProcessError(proc.returncode, cmd)
+
+
+def write_key_info(work_dir, encryption):
+    """
+    Writes the content key and the key info file ffmpeg encrypts the segments with.
+    Without an IV line ffmpeg uses the media sequence number, like the Go runner.
+    """
+    key_path = os.path.join(work_dir, "content.key")
+    with open(key_path, "wb") as f:
+        f.write(bytes.fromhex(encryption["key"]))
+    info_path = os.path.join(work_dir, "content.keyinfo")
+    with open(info_path, "w") as f:
+        f.write(f"{encryption['key_uri']}\n{key_path}\n")
+    return info_path
 
 
 #new transcoding method
 @shared_task(name='tasks.transcode_and_upload_video', queue='video_tasks', bind=True)
-def process_video_from_s3(self, upload_id: str, s3_key: str):
+def process_video_from_s3(self, upload_id: str, s3_key: str, profile=None, output_prefix: str = "", poster_at=None,
+                          encryption=None):
     """
     Celery task that uses a presigned URL to stream a video directly
     from S3 into ffmpeg for transcoding.
+    The renditions are written below output_prefix (videos/<id> or videos/<id>/v<n>
+    for re-transcodes), the original stays in the pending bucket.
+    poster_at picks the second the poster and thumbnail are taken from.
+    encryption ({"key": hex, "key_uri": ...}) encrypts the segments with AES-128,
+    the key itself never leaves the work folder.
     """
 
-    channel = f"job_status_{upload_id}"
+    profile = resolve_profile(profile)
+    output_prefix = (output_prefix or f"videos/{upload_id}").rstrip("/")
+    print(f"Worker transcoding {upload_id} with profile {profile['name']} into {output_prefix}")
+
+    variants = profile["renditions"]
+    encoder = ENCODERS.get(profile.get("codec"), "h264_nvenc")
+    segment_duration = str(profile.get("segment_duration") or 6)
+    events = JobEvents(redis_client_sync, upload_id, [r["name"] for r in variants])
+    events.status("processing")
 
     with tempfile.TemporaryDirectory() as work_root:
         try:
@@ -33,14 +102,24 @@ def process_video_from_s3(self, upload_id: str, s3_key: str):
             )
             print(f"Worker generated presigned URL for {s3_key}")
 
+            events.set_stage("probing")
+            duration = probe_duration(presigned_url)
+
+            key_args = []
+            if encryption:
+                key_args = ["-hls_key_info_file", write_key_info(work_root, encryption)]
+
             # 2. Transcode using the URL directly as input
             print(f"Worker starting transcoding for {upload_id} from URL")
-            variants = [360, 480, 720, 1080]
+            events.set_stage("transcoding")
 
-            def transcode(res):
-                out_dir = os.path.join(work_root, f"{res}p")
+            def transcode(variant):
+                rendition = variant["name"]
+                events.rendition(rendition, state="running")
+                out_dir = os.path.join(work_root, rendition)
                 os.makedirs(out_dir, exist_ok=True)
                 playlist = os.path.join(out_dir, "playlist.m3u8")
+                video_bitrate = variant["video_bitrate"]
                 
                 # The change here is: -i now uses the presigned URL
                 cmd = [
@@ -49,42 +128,81 @@ def process_video_from_s3(self, upload_id: str, s3_key: str):
                         "-i", presigned_url,
                         
                         # The explicit, high-quality GPU scaling filter
-                        "-vf", f"hwupload_cuda,scale_cuda=w=-2:h={res}:format=nv12:interp_algo=lanczos",
+                        "-vf", f"hwupload_cuda,scale_cuda=w=-2:h={variant['height']}:format=nv12:interp_algo=lanczos",
                         
                         # Correct encoder settings for high-quality VOD
-                        "-c:v", "h264_nvenc",
+                        "-c:v", encoder,
                         "-preset", "p5",          # Use a quality-focused preset (p5 is a great balance)
                         "-tune", "hq",           # Tune for High Quality (NOT low latency)
                         "-rc", "vbr",            # Use Variable Bitrate for efficiency
                         "-cq", "24",             # Constant Quality level
-                        "-b:v", "0",             # Required for VBR/CQ mode
+                        "-b:v", str(video_bitrate),              # Target bitrate from the profile
+                        "-maxrate", str(int(video_bitrate * 1.5)),
+                        "-bufsize", str(video_bitrate * 2),
                         "-bf", "2",              # Allow 2 B-frames for better compression
                         "-g", "48",              # Shorter GOP size for better HLS performance
                         "-keyint_min", "48",
                         
-                        # Audio and HLS settings (unchanged)
+                        # Audio and HLS settings
                         "-c:a", "aac", 
-                        "-b:a", "128k",
+                        "-b:a", str(variant["audio_bitrate"]),
                         "-f", "hls",
-                        "-hls_time", "6",
+                        "-hls_time", segment_duration,
                         "-hls_playlist_type", "vod",
-                        "-hls_segment_filename", f"{out_dir}/seg_%03d.ts",
+                        *hls_segment_args(profile, out_dir),
+                        *key_args,
                         playlist
                 ]
-                subprocess.run(cmd, check=True)
+                try:
+                    run_ffmpeg(cmd, duration, lambda pct: events.rendition(rendition, percent=pct))
+                except Exception:
+                    events.rendition(rendition, state="failed")
+                    raise
+                events.rendition(rendition, state="done")
                 return out_dir
 
             with ThreadPoolExecutor() as exe:
                 out_dirs = list(exe.map(transcode, variants))
             print(f"Worker finished transcoding for {upload_id}")
+
+            # stills and sprites are extras, the renditions are served without them.
+            # What could not be made is listed in the metadata
+            events.set_stage("thumbnails")
+            thumbs_dir = os.path.join(work_root, THUMBS_DIR)
+            os.makedirs(thumbs_dir, exist_ok=True)
+            warnings = {}
+            try:
+                generate_stills(presigned_url, thumbs_dir, duration, poster_at)
+            except Exception as e:
+                print(f"Worker could not generate the poster of {upload_id}: {e}")
+                warnings["thumbnails"] = str(e) or type(e).__name__
+            try:
+                generate_sprites(presigned_url, thumbs_dir, duration)
+            except Exception as e:
+                print(f"Worker could not generate the sprites of {upload_id}: {e}")
+                warnings["sprites"] = str(e) or type(e).__name__
+
+            # a missing description must not fail an otherwise good transcode
+            metadata_path = None
+            try:
+                size_bytes = s3.head_object(Bucket=PENDING_BUCKET, Key=s3_key)["ContentLength"]
+                metadata_path = write_metadata(
+                    presigned_url, size_bytes,
+                    {v["name"]: d for v, d in zip(variants, out_dirs)},
+                    os.path.join(work_root, METADATA_FILE),
+                    warnings,
+                )
+            except Exception as e:
+                print(f"Worker could not extract media metadata for {upload_id}: {e}")
             
             # 3. Uploading the HLS folders 
+            events.set_stage("uploading")
             def upload_folder(local_dir, s3_prefix):
                 for root, _, files in os.walk(local_dir):
                     for fname in files:
                         local_path = os.path.join(root, fname)
                         rel_path   = os.path.relpath(local_path, local_dir)
-                        s3_key     = f"videos/{upload_id}/{s3_prefix}/{rel_path}"
+                        s3_key     = f"{output_prefix}/{s3_prefix}/{rel_path}"
                         content_type = guess_type(fname)[0] or "application/octet-stream"
                         s3.upload_file(
                             Filename=local_path,
@@ -92,26 +210,41 @@ def process_video_from_s3(self, upload_id: str, s3_key: str):
                             Key=s3_key,
                             ExtraArgs={"ContentType": content_type},
                         )
+                        events.progress()  # throttled, keeps the job alive for the watchdog
 
             
             with ThreadPoolExecutor() as exe:
-                for res, out_dir in zip(variants, out_dirs):
-                    exe.submit(upload_folder, out_dir, f"{res}p")
+                for variant, out_dir in zip(variants, out_dirs):
+                    exe.submit(upload_folder, out_dir, variant["name"])
+                exe.submit(upload_folder, thumbs_dir, THUMBS_DIR)
 
-            # master playlist generation..
+            if metadata_path:
+                s3.upload_file(
+                    Filename=metadata_path,
+                    Bucket=STREAMING_BUCKET,
+                    Key=f"{output_prefix}/{METADATA_FILE}",
+                    ExtraArgs={"ContentType": "application/json"},
+                )
 
-            variant_info = {
-                360: {"bandwidth": 800000, "resolution": "640x360"},
-                480: {"bandwidth": 1400000, "resolution": "854x480"},
-                720: {"bandwidth": 2800000, "resolution": "1280x720"},
-                1080: {"bandwidth": 5000000, "resolution": "1920x1080"},
-            }
+            # CMAF renditions are listed in a DASH manifest as well, the segments are shared.
+            # Players would need CENC rather than AES-128 to decrypt them, so encrypted ones are HLS only.
+            if profile.get("container") == "fmp4" and not profile.get("single_file") and not encryption:
+                manifest_path = write_manifest(profile, variants, out_dirs, os.path.join(work_root, MANIFEST_FILE))
+                s3.upload_file(
+                    Filename=manifest_path,
+                    Bucket=STREAMING_BUCKET,
+                    Key=f"{output_prefix}/{MANIFEST_FILE}",
+                    ExtraArgs={"ContentType": "application/dash+xml"},
+                )
 
-            master_playlist_content = ['#EXTM3U', '#EXT-X-VERSION:3']
-            for res in variants:
-                info = variant_info[res]
-                master_playlist_content.append(f'#EXT-X-STREAM-INF:BANDWIDTH={info["bandwidth"]},RESOLUTION={info["resolution"]}')
-                master_playlist_content.append(f'{res}p/playlist.m3u8')
+            # master playlist generation..
+
+            master_playlist_content = ['#EXTM3U', f'#EXT-X-VERSION:{hls_version(profile)}']
+            for variant in variants:
+                bandwidth = variant["video_bitrate"] + variant["audio_bitrate"]
+                resolution = f'{variant["width"]}x{variant["height"]}'
+                master_playlist_content.append(f'#EXT-X-STREAM-INF:BANDWIDTH={bandwidth},RESOLUTION={resolution}')
+                master_playlist_content.append(f'{variant["name"]}/playlist.m3u8')
             
             master_playlist_path = os.path.join(work_root, "master.m3u8")
             with open(master_playlist_path, "w") as f:
@@ -121,25 +254,82 @@ def process_video_from_s3(self, upload_id: str, s3_key: str):
             s3.upload_file(
                 Filename=master_playlist_path,
                 Bucket=STREAMING_BUCKET,
-                Key=f"videos/{upload_id}/master.m3u8",
+                Key=f"{output_prefix}/master.m3u8",
                 ExtraArgs={"ContentType": "application/vnd.apple.mpegurl"},
             )
-            print(f"Worker uploaded master playlist for {upload_id} to s3://{STREAMING_BUCKET}/videos/{upload_id}/master.m3u8")
+            print(f"Worker uploaded master playlist for {upload_id} to s3://{STREAMING_BUCKET}/{output_prefix}/master.m3u8")
 
-            redis_client_sync.publish(channel, "ready")
+            events.status("ready")
             
-            return {"status": "success", "upload_id": upload_id}
+            return {
+                "status": "success",
+                "upload_id": upload_id,
+                "output_prefix": output_prefix,
+                "renditions": [v["name"] for v in variants],
+            }
 
         except Exception as e:
             print(f"Error processing {upload_id}: {e}")
-            self.update_state(state='FAILURE', meta={'exc': str(e)})
-            redis_client_sync.publish(channel, "failed")
+            events.status("failed", error=e, code=type(e).__name__)
             raise
 
-        finally:
-            # 4. CLEANUP 
-            try:
-                s3.delete_object(Bucket=PENDING_BUCKET, Key=s3_key)
-                print(f"Worker cleaned up s3://{PENDING_BUCKET}/{s3_key}")
-            except Exception as e:
-                print(f"Error cleaning up pending file for {upload_id}: {e}")
\ No newline at end of file
+
+@shared_task(name='tasks.package_audio_track', queue='video_tasks', bind=True)
+def package_audio_track(self, upload_id: str, s3_key: str, language: str, output_prefix: str = "",
+                        bitrate=128000, segment_duration=6, container="ts"):
+    """
+    Packages an extra audio file (a dub, a commentary..) as an AAC HLS rendition
+    below output_prefix (videos/<id>/audio_<lang>), the api lists it in the
+    master as an EXT-X-MEDIA TYPE=AUDIO entry once it is ready.
+    container matches the segments of the video renditions, "ts" or "fmp4".
+    """
+
+    output_prefix = (output_prefix or f"videos/{upload_id}/audio_{language}").rstrip("/")
+    print(f"Worker packaging {language} audio of {upload_id} into {output_prefix}")
+
+    events = JobEvents(redis_client_sync, upload_id, [])
+    events.track("audio", language, "processing")
+
+    with tempfile.TemporaryDirectory() as work_dir:
+        try:
+            presigned_url = s3.generate_presigned_url(
+                'get_object',
+                Params={'Bucket': PENDING_BUCKET, 'Key': s3_key},
+                ExpiresIn=3600
+            )
+
+            cmd = [
+                "ffmpeg", "-y", "-v", "error",
+                "-i", presigned_url,
+                "-vn",
+                "-c:a", "aac",
+                "-b:a", str(bitrate),
+                "-f", "hls",
+                "-hls_time", str(segment_duration or 6),
+                "-hls_playlist_type", "vod",
+                *hls_segment_args({"container": container or "ts"}, work_dir),
+                os.path.join(work_dir, "playlist.m3u8"),
+            ]
+            subprocess.run(cmd, check=True)
+
+            for fname in os.listdir(work_dir):
+                content_type = guess_type(fname)[0] or "application/octet-stream"
+                s3.upload_file(
+                    Filename=os.path.join(work_dir, fname),
+                    Bucket=STREAMING_BUCKET,
+                    Key=f"{output_prefix}/{fname}",
+                    ExtraArgs={"ContentType": content_type},
+                )
+
+            events.track("audio", language, "ready")
+            return {
+                "status": "success",
+                "upload_id": upload_id,
+                "language": language,
+                "output_prefix": output_prefix,
+            }
+
+        except Exception as e:
+            print(f"Error packaging {language} audio of {upload_id}: {e}")
+            events.track("audio", language, "failed", error=f"{type(e).__name__}: {e}")
+            raise
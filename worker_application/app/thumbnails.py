@@ -0,0 +1,98 @@
+import math
+import os
+import subprocess
+
+# folder below the output prefix the still images are written to
+THUMBS_DIR = "thumbs"
+
+# largest poster height, the poster is never upscaled
+POSTER_MAX_HEIGHT = 720
+THUMB_WIDTH = 320
+
+# scrub preview sprites: cells of SPRITE_WIDTH x SPRITE_HEIGHT, SPRITE_COLUMNS x SPRITE_ROWS per sheet,
+# one cell every SPRITE_INTERVAL seconds but never more than SPRITE_MAX_CELLS per video
+SPRITE_WIDTH = 160
+SPRITE_HEIGHT = 90
+SPRITE_COLUMNS = 10
+SPRITE_ROWS = 10
+SPRITE_INTERVAL = 5.0
+SPRITE_MAX_CELLS = 300
+
+
+def poster_time(duration, poster_at=None):
+    """Seconds into the video the poster frame is taken from."""
+    if poster_at is not None:
+        t = max(0.0, float(poster_at))
+        if duration:
+            t = min(t, max(0.0, duration - 0.1))
+        return t
+    # skip black intro frames, 10% in is usually representative
+    return duration * 0.1 if duration else 1.0
+
+
+def generate_stills(url, out_dir, duration, poster_at=None):
+    """
+    Writes poster.jpg and the small thumb.jpg of the same frame into out_dir.
+    """
+    os.makedirs(out_dir, exist_ok=True)
+    t = poster_time(duration, poster_at)
+    cmd = [
+        "ffmpeg", "-y", "-v", "error",
+        "-ss", f"{t:.3f}",
+        "-i", url,
+        "-frames:v", "1", "-vf", f"scale=-2:'min({POSTER_MAX_HEIGHT},ih)'", "-q:v", "3",
+        os.path.join(out_dir, "poster.jpg"),
+        "-frames:v", "1", "-vf", f"scale={THUMB_WIDTH}:-2", "-q:v", "4",
+        os.path.join(out_dir, "thumb.jpg"),
+    ]
+    subprocess.run(cmd, check=True)
+    return out_dir
+
+
+def vtt_timestamp(seconds):
+    ms = int(round(seconds * 1000))
+    h, ms = divmod(ms, 3_600_000)
+    m, ms = divmod(ms, 60_000)
+    s, ms = divmod(ms, 1000)
+    return f"{h:02d}:{m:02d}:{s:02d}.{ms:03d}"
+
+
+def sprite_vtt(duration, interval):
+    """WebVTT track mapping each interval to its cell, image references are relative to the thumbs folder."""
+    per_sheet = SPRITE_COLUMNS * SPRITE_ROWS
+    lines = ["WEBVTT", ""]
+    for i in range(math.ceil(duration / interval)):
+        start, end = i * interval, min((i + 1) * interval, duration)
+        sheet, cell = divmod(i, per_sheet)
+        row, col = divmod(cell, SPRITE_COLUMNS)
+        lines.append(f"{vtt_timestamp(start)} --> {vtt_timestamp(end)}")
+        lines.append(f"sprite_{sheet + 1:03d}.jpg#xywh={col * SPRITE_WIDTH},{row * SPRITE_HEIGHT},{SPRITE_WIDTH},{SPRITE_HEIGHT}")
+        lines.append("")
+    return "\n".join(lines)
+
+
+def generate_sprites(url, out_dir, duration):
+    """
+    Writes the sprite_NNN.jpg sheets and sprites.vtt into out_dir.
+    Without a known duration no track can be built and nothing is written.
+    """
+    if not duration:
+        return out_dir
+    os.makedirs(out_dir, exist_ok=True)
+    interval = max(SPRITE_INTERVAL, duration / SPRITE_MAX_CELLS)
+    cell = (
+        f"scale={SPRITE_WIDTH}:{SPRITE_HEIGHT}:force_original_aspect_ratio=decrease,"
+        f"pad={SPRITE_WIDTH}:{SPRITE_HEIGHT}:(ow-iw)/2:(oh-ih)/2"
+    )
+    cmd = [
+        "ffmpeg", "-y", "-v", "error",
+        "-i", url,
+        "-an",
+        "-vf", f"fps=1/{interval:.3f},{cell},tile={SPRITE_COLUMNS}x{SPRITE_ROWS}",
+        "-q:v", "5",
+        os.path.join(out_dir, "sprite_%03d.jpg"),
+    ]
+    subprocess.run(cmd, check=True)
+    with open(os.path.join(out_dir, "sprites.vtt"), "w") as f:
+        f.write(sprite_vtt(duration, interval))
+    return out_dir